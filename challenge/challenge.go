@@ -0,0 +1,54 @@
+package challenge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+)
+
+// Verifier checks a challenge token a client got by solving a human verification challenge, such as a captcha.
+type Verifier interface {
+	// Verify reports if the token is valid for a client at the given ip, an error means the token could not be checked.
+	Verify(ctx context.Context, token string, ip string) (bool, error)
+}
+
+// Default is the verifier configured by challenge_provider, nil when human verification is disabled.
+var Default Verifier
+
+// Timeout bounds how long a verification may take.
+const Timeout = 5 * time.Second
+
+func init() {
+	v, err := New(configure.Config.GetString("challenge_provider"), configure.Config.GetString("challenge_secret"))
+	if err != nil {
+		panic(err)
+	}
+	Default = v
+
+	if Default == nil && configure.Config.GetBool("require_challenge") {
+		log.Warn("require_challenge is set without a challenge_provider, challenges will not be required")
+	}
+}
+
+// New creates the verifier for a provider, an empty provider disables human verification.
+func New(provider string, secret string) (Verifier, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case "hcaptcha":
+		return NewHTTPVerifier(HCaptchaURL, secret), nil
+	case "turnstile":
+		return NewHTTPVerifier(TurnstileURL, secret), nil
+	case "fake":
+		return Fake{Token: secret}, nil
+	}
+	return nil, fmt.Errorf("unknown challenge provider %q", provider)
+}
+
+// Required reports if every vote and poll creation must pass a challenge.
+func Required() bool {
+	return Default != nil && configure.Config.GetBool("require_challenge")
+}
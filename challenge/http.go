@@ -0,0 +1,70 @@
+package challenge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+const (
+	HCaptchaURL  = "https://hcaptcha.com/siteverify"
+	TurnstileURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// HTTPVerifier verifies tokens against a siteverify endpoint, as used by hCaptcha and Cloudflare Turnstile.
+type HTTPVerifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewHTTPVerifier(url string, secret string) *HTTPVerifier {
+	return &HTTPVerifier{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: Timeout},
+	}
+}
+
+type siteverifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (v *HTTPVerifier) Verify(ctx context.Context, token string, ip string) (bool, error) {
+	form := url.Values{
+		"secret":   {v.Secret},
+		"response": {token},
+	}
+	if ip != "" {
+		form.Set("remoteip", ip)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify status %d", res.StatusCode)
+	}
+
+	body := siteverifyResponse{}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	return body.Success, nil
+}
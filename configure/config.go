@@ -13,12 +13,35 @@ import (
 )
 
 type ServerCfg struct {
-	Level      string `mapstructure:"level"`
-	ConfigFile string `mapstructure:"config_file"`
-	RedisURI   string `mapstructure:"redis_uri"`
-	MongoURI   string `mapstructure:"mongo_uri"`
-	MongoDB    string `mapstructure:"mongo_db"`
-	ExitCode   int    `mapstructure:"exit_code"`
+	Level                string   `mapstructure:"level"`
+	ConfigFile           string   `mapstructure:"config_file"`
+	RedisURI             string   `mapstructure:"redis_uri"`
+	MongoURI             string   `mapstructure:"mongo_uri"`
+	MongoDB              string   `mapstructure:"mongo_db"`
+	ExitCode             int      `mapstructure:"exit_code"`
+	SnapshotInterval     int      `mapstructure:"snapshot_interval"`
+	ReconcileInterval    int      `mapstructure:"reconcile_interval"`
+	RebuildTallies       bool     `mapstructure:"rebuild_tallies"`
+	ReconcileTallies     bool     `mapstructure:"reconcile_tallies"`
+	TallyPoll            string   `mapstructure:"tally_poll"`
+	IdempotencyTTL       int      `mapstructure:"idempotency_ttl"`
+	VoterTokenSecret     string   `mapstructure:"voter_token_secret"`
+	TrustedProxies       []string `mapstructure:"trusted_proxies"`
+	ProxyProtocol        bool     `mapstructure:"proxy_protocol"`
+	ChallengeProvider    string   `mapstructure:"challenge_provider"`
+	ChallengeSecret      string   `mapstructure:"challenge_secret"`
+	RequireChallenge     bool     `mapstructure:"require_challenge"`
+	AnomalyNetworkLimit  int      `mapstructure:"anomaly_network_limit"`
+	AnomalyNetworkWindow int      `mapstructure:"anomaly_network_window"`
+	AnomalyOptionRate    int      `mapstructure:"anomaly_option_rate"`
+
+	RateLimits map[string]map[string]RateLimitCfg `mapstructure:"rate_limits"`
+}
+
+// RateLimitCfg is a budget of Limit requests per Window seconds, a Limit of 0 disables the budget.
+type RateLimitCfg struct {
+	Limit  int `mapstructure:"limit"`
+	Window int `mapstructure:"window"`
 }
 
 // default config
@@ -61,6 +84,28 @@ func init() {
 	pflag.String("mongodb", "", "Database for the mongodb connection.")
 	pflag.String("version", "1.0", "Version of the system.")
 	pflag.Int("exit_code", 0, "Status code for successful and graceful shutdown, [0-125].")
+	pflag.Int("snapshot_interval", 30, "Seconds between snapshots of vote tallies into mongodb.")
+	pflag.Int("reconcile_interval", 3600, "Seconds between checks of snapshotted vote tallies against their ballots.")
+	pflag.Bool("rebuild_tallies", false, "Rebuild the vote tallies in redis from the ballots in mongodb and exit.")
+	pflag.Bool("reconcile_tallies", false, "Report where the vote tallies in redis differ from the ballots in mongodb and exit.")
+	pflag.String("tally_poll", "", "Limit rebuild_tallies and reconcile_tallies to a single poll id.")
+	pflag.Int("idempotency_ttl", 86400, "Seconds the result of a mutation is kept for retries with the same idempotency key.")
+	pflag.String("voter_token_secret", "", "Secret used to sign voter tokens, voter tokens are disabled when empty.")
+	pflag.StringSlice("trusted_proxies", nil, "CIDRs of the proxies in front of the server, forwarding headers are only read from these.")
+	pflag.String("challenge_provider", "", "Human verification provider, one of hcaptcha, turnstile or fake. Disabled when empty.")
+	pflag.String("challenge_secret", "", "Secret key of the challenge provider, for the fake provider the only token it accepts.")
+	pflag.Bool("require_challenge", false, "Require human verification on every vote and poll creation.")
+	pflag.Int("anomaly_network_limit", 100, "Votes on a poll from one ipv4 /24 or ipv6 /64 network per anomaly_network_window before ballots are quarantined, 0 disables.")
+	pflag.Int("anomaly_network_window", 10, "Seconds per window of anomaly_network_limit.")
+	pflag.Int("anomaly_option_rate", 0, "Votes per second on a single option before ballots are quarantined, 0 disables. Off by default as busy polls can legitimately go over any fixed rate.")
+	pflag.Int("watch_throttle_min", 250, "Least milliseconds a watch can ask for between updates.")
+	pflag.Int("watch_throttle_max", 30000, "Most milliseconds a watch can ask for between updates.")
+	pflag.Int("watch_throttle_default", 1000, "Milliseconds between updates of a watch that does not ask for a throttle.")
+	pflag.Int("watch_frame_budget", 20000, "Updates per second shared by every watch on the instance, watches slow down past it, 0 disables.")
+	pflag.Int("watch_many_max", 25, "Most polls a single watchMany subscription can watch.")
+	pflag.Int("event_retention", 1000, "Events kept per poll for replaying to clients that reconnect.")
+	pflag.Int("event_ttl", 604800, "Seconds the events of a closed poll are kept after its last event.")
+	pflag.Bool("proxy_protocol", false, "Read PROXY protocol headers on the listener from trusted_proxies, the server does not start if none are set.")
 	pflag.Parse()
 	checkErr(Config.BindPFlags(pflag.CommandLine))
 
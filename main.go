@@ -9,21 +9,29 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/troydota/api.poll.komodohype.dev/configure"
-	_ "github.com/troydota/api.poll.komodohype.dev/mongo"
-	_ "github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
 	"github.com/troydota/api.poll.komodohype.dev/server"
+	"github.com/troydota/api.poll.komodohype.dev/server/gql/resolvers"
 )
 
 func main() {
 	log.Infoln("Application Starting...")
 
+	mongo.Init()
+	redis.Init()
+
 	configCode := configure.Config.GetInt("exit_code")
 	if configCode > 125 || configCode < 0 {
 		log.Warnf("Invalid exit code specified in config (%v), using 0 as new exit code.", configCode)
 		configCode = 0
 	}
 
-	c := make(chan os.Signal)
+	if configure.Config.GetBool("rebuild_tallies") || configure.Config.GetBool("reconcile_tallies") {
+		os.Exit(tallyCommand())
+	}
+
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
 	s := server.NewServer()
@@ -53,3 +61,40 @@ func main() {
 
 	select {}
 }
+
+// tallyCommand runs the rebuild_tallies and reconcile_tallies commands, returning the exit code.
+func tallyCommand() int {
+	ids := []string{configure.Config.GetString("tally_poll")}
+	if ids[0] == "" {
+		var err error
+		if ids, err = resolvers.AllPollIDs(); err != nil {
+			log.Errorf("mongo, err=%v", err)
+			return 1
+		}
+	}
+
+	code := 0
+	for _, id := range ids {
+		if configure.Config.GetBool("reconcile_tallies") {
+			drift, err := resolvers.ReconcileTally(id)
+			if err != nil {
+				log.Errorf("reconcile, poll=%s err=%v", id, err)
+				code = 1
+				continue
+			}
+			for _, d := range drift {
+				log.Warnf("reconcile, drift poll=%s key=%s field=%s redis=%d ballots=%d", d.PollID, d.Key, d.Field, d.Redis, d.Ballots)
+			}
+		}
+		if configure.Config.GetBool("rebuild_tallies") {
+			if err := resolvers.RebuildTally(id); err != nil {
+				log.Errorf("rebuild, poll=%s err=%v", id, err)
+				code = 1
+				continue
+			}
+			log.Infof("rebuild, poll=%s", id)
+		}
+	}
+
+	return code
+}
@@ -16,7 +16,12 @@ var Ctx = context.TODO()
 
 var ErrNoDocuments = mongo.ErrNoDocuments
 
-func init() {
+var IsDuplicateKeyError = mongo.IsDuplicateKeyError
+
+type BulkWriteException = mongo.BulkWriteException
+
+// Init connects to mongo and creates the indexes, it panics if mongo cannot be reached. main calls it before anything uses Database.
+func Init() {
 	clientOptions := options.Client().ApplyURI(configure.Config.GetString("mongo_uri"))
 	client, err := mongo.Connect(Ctx, clientOptions)
 	if err != nil {
@@ -38,4 +43,32 @@ func init() {
 		log.Errorf("mongodb, err=%v", err)
 		return
 	}
+
+	_, err = Database.Collection("pollanswers").Indexes().CreateOne(Ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "poll_id", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{
+			"seq": bson.M{"$exists": true},
+		}),
+	})
+	if err != nil {
+		log.Errorf("mongodb, err=%v", err)
+		return
+	}
+
+	_, err = Database.Collection("ballottree").Indexes().CreateOne(Ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "poll_id", Value: 1}, {Key: "level", Value: 1}, {Key: "index", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Errorf("mongodb, err=%v", err)
+		return
+	}
+
+	_, err = Database.Collection("draftversions").Indexes().CreateOne(Ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "draft_id", Value: 1}, {Key: "version", Value: 1}},
+	})
+	if err != nil {
+		log.Errorf("mongodb, err=%v", err)
+		return
+	}
 }
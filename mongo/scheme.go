@@ -7,28 +7,72 @@ import (
 )
 
 type Poll struct {
-	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Title       string             `json:"title" bson:"title"`
-	OptionsRaw  []string           `json:"options" bson:"options"`
-	CheckIP     bool               `json:"check_ip" bson:"check_ip"`
-	MultiAnswer bool               `json:"multi_answer" bson:"multi_answer"`
-	Expiry      *time.Time         `json:"expiry" bson:"expiry"`
-
-	Options *[]PollOption `json:"-" bson:"-"`
+	ID               primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Title            string              `json:"title" bson:"title"`
+	Type             string              `json:"type" bson:"type"`
+	OptionsRaw       []string            `json:"options" bson:"options"`
+	CheckIP          bool                `json:"check_ip" bson:"check_ip"`
+	DedupMode        string              `json:"dedup_mode" bson:"dedup_mode,omitempty"`
+	RequireChallenge bool                `json:"require_challenge" bson:"require_challenge,omitempty"`
+	MultiAnswer      bool                `json:"multi_answer" bson:"multi_answer"`
+	MinSelections    int32               `json:"min_selections" bson:"min_selections"`
+	MaxSelections    int32               `json:"max_selections" bson:"max_selections"`
+	ScoreMin         int32               `json:"score_min" bson:"score_min"`
+	ScoreMax         int32               `json:"score_max" bson:"score_max"`
+	OpensAt          *time.Time          `json:"opens_at" bson:"opens_at,omitempty"`
+	Expiry           *time.Time          `json:"expiry" bson:"expiry"`
+	Closed           bool                `json:"closed" bson:"closed"`
+	ClosedAt         *time.Time          `json:"closed_at" bson:"closed_at"`
+	DraftID          *primitive.ObjectID `json:"draft_id" bson:"draft_id,omitempty"`
+	Results          *[]PollOption       `json:"results,omitempty" bson:"results,omitempty"`
+	ResultsAt        *time.Time          `json:"results_at,omitempty" bson:"results_at,omitempty"`
+
+	AdminTokenHash string `json:"admin_token_hash" bson:"admin_token_hash"`
+	// EventSeq is the seq of the last event published while the poll was closed, the event keys of closed polls expire from redis.
+	EventSeq int64 `json:"event_seq,omitempty" bson:"event_seq,omitempty"`
+
+	Options  *[]PollOption `json:"-" bson:"-"`
+	Watchers *int32        `json:"-" bson:"-"`
+	Seq      *int64        `json:"-" bson:"-"`
 }
 
 type Draft struct {
-	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Title       string             `json:"title" bson:"title"`
-	Options     []string           `json:"options" bson:"options"`
-	CheckIP     bool               `json:"check_ip" bson:"check_ip"`
-	MultiAnswer bool               `json:"multi_answer" bson:"multi_answer"`
-	Expiry      *int32             `json:"expiry" bson:"expiry"`
+	ID               primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Title            string              `json:"title" bson:"title"`
+	Type             string              `json:"type" bson:"type"`
+	Options          []string            `json:"options" bson:"options"`
+	CheckIP          bool                `json:"check_ip" bson:"check_ip"`
+	DedupMode        string              `json:"dedup_mode" bson:"dedup_mode,omitempty"`
+	RequireChallenge bool                `json:"require_challenge" bson:"require_challenge,omitempty"`
+	MultiAnswer      bool                `json:"multi_answer" bson:"multi_answer"`
+	MinSelections    int32               `json:"min_selections" bson:"min_selections"`
+	MaxSelections    int32               `json:"max_selections" bson:"max_selections"`
+	ScoreMin         int32               `json:"score_min" bson:"score_min"`
+	ScoreMax         int32               `json:"score_max" bson:"score_max"`
+	OpensAt          *int32              `json:"opens_at" bson:"opens_at,omitempty"`
+	Expiry           *int32              `json:"expiry" bson:"expiry"`
+	Published        int32               `json:"published" bson:"published"`
+	LastPollID       *primitive.ObjectID `json:"last_poll_id" bson:"last_poll_id,omitempty"`
+	Version          int32               `json:"version" bson:"version"`
+	UpdatedAt        *time.Time          `json:"updated_at" bson:"updated_at,omitempty"`
+
+	AdminTokenHash string `json:"admin_token_hash" bson:"admin_token_hash"`
+}
+
+type DraftVersion struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	DraftID    primitive.ObjectID `json:"draft_id" bson:"draft_id"`
+	Version    int32              `json:"version" bson:"version"`
+	ReplacedAt time.Time          `json:"replaced_at" bson:"replaced_at"`
+	Draft      Draft              `json:"draft" bson:"draft"`
 }
 
 type PollOption struct {
-	Title string `json:"title"`
-	Votes int32  `json:"votes"`
+	Title     string   `json:"title" bson:"title"`
+	Votes     int32    `json:"votes" bson:"votes"`
+	Average   *float64 `json:"average" bson:"average,omitempty"`
+	Count     int32    `json:"count" bson:"count"`
+	Histogram *[]int32 `json:"histogram" bson:"histogram,omitempty"`
 }
 
 type PollAnswer struct {
@@ -36,4 +80,25 @@ type PollAnswer struct {
 	PollID primitive.ObjectID `json:"poll_id" bson:"poll_id"`
 	IP     string             `json:"ip" bson:"ip"`
 	Answer []int32            `json:"answer" bson:"answer"`
+	Voter  []string           `json:"voter,omitempty" bson:"voter,omitempty"`
+	Flags  []string           `json:"flags,omitempty" bson:"flags,omitempty"`
+	// Kind is empty for ballots, release entries of the ballot log are kept with the ballots and have no selection.
+	Kind string `json:"kind,omitempty" bson:"kind,omitempty"`
+
+	// The ballot log fields, set when the ballot is written to mongo. Ballots cast before the ballot log existed have none.
+	Digest string `json:"digest,omitempty" bson:"digest,omitempty"`
+	Seq    *int32 `json:"seq,omitempty" bson:"seq,omitempty"`
+	Prev   string `json:"prev,omitempty" bson:"prev,omitempty"`
+	Leaf   string `json:"leaf,omitempty" bson:"leaf,omitempty"`
+}
+
+// MerkleNode is a complete node of the Merkle tree over the ballot log of a poll, covering the digests index*2^level up to (index+1)*2^level.
+type MerkleNode struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	PollID primitive.ObjectID `json:"poll_id" bson:"poll_id"`
+	Level  int32              `json:"level" bson:"level"`
+	Index  int32              `json:"index" bson:"index"`
+	// Last is the seq of the last digest the node covers.
+	Last int32  `json:"last" bson:"last"`
+	Hash string `json:"hash" bson:"hash"`
 }
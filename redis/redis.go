@@ -11,7 +11,8 @@ var Ctx = context.Background()
 
 var Client *redis.Client
 
-func init() {
+// Init creates the redis client, it panics if redis_uri is not valid. main calls it before anything uses Client.
+func Init() {
 	options, err := redis.ParseURL(configure.Config.GetString("redis_uri"))
 	if err != nil {
 		panic(err)
@@ -30,4 +31,16 @@ type Pipeliner = redis.Pipeliner
 
 type StringStringMapCmd = redis.StringStringMapCmd
 
+type IntCmd = redis.IntCmd
+
 type PubSub = redis.PubSub
+
+type Z = redis.Z
+
+type ZRangeBy = redis.ZRangeBy
+
+type Script = redis.Script
+
+func NewScript(src string) *Script {
+	return redis.NewScript(src)
+}
@@ -34,6 +34,31 @@ type WSResponse struct {
 	SubscriptionID string      `json:"sub_id,omitempty"`
 }
 
+// voterToken returns the voter token of a request, sent either in the X-Voter-Token header or the voter_token cookie.
+// The token is copied as fiber reuses the request buffer once the handler returns, which websocket connections outlive.
+func voterToken(c *fiber.Ctx) string {
+	token := c.Get("X-Voter-Token")
+	if token == "" {
+		token = c.Cookies("voter_token")
+	}
+	return string(append([]byte(nil), token...))
+}
+
+// voterTokenCookie sets a newly issued voter token as the voter_token cookie of the response, so browsers send it with their votes.
+func voterTokenCookie(c *fiber.Ctx) func(string) {
+	return func(token string) {
+		c.Cookie(&fiber.Cookie{
+			Name:     "voter_token",
+			Value:    token,
+			Path:     "/",
+			Expires:  time.Now().AddDate(1, 0, 0),
+			Secure:   c.Secure(),
+			HTTPOnly: true,
+			SameSite: "Lax",
+		})
+	}
+}
+
 func GQL(app fiber.Router) {
 	gql := app.Group("/gql")
 
@@ -47,6 +72,11 @@ func GQL(app fiber.Router) {
 
 	schema := graphql.MustParseSchema(s, resolvers.New(), graphql.UseFieldResolvers())
 
+	ips := newIPResolver()
+
+	// Registered ahead of the upgrade check, which answers every other GET with 426.
+	gql.Get("/sse", sseHandler(schema, ips))
+
 	gql.Use(func(c *fiber.Ctx) error {
 		if c.Method() != "GET" {
 			return c.Next()
@@ -54,14 +84,8 @@ func GQL(app fiber.Router) {
 		// IsWebSocketUpgrade returns true if the client
 		// requested upgrade to the WebSocket protocol.
 		if websocket.IsWebSocketUpgrade(c) {
-			var ip string
-			ips := c.IPs()
-			if len(ips) > 0 {
-				ip = ips[0]
-			} else {
-				ip = c.IP()
-			}
-			c.Locals("ip", ip)
+			c.Locals("ip", ips.clientIP(c))
+			c.Locals("voter_token", voterToken(c))
 			return c.Next()
 		}
 		return c.SendStatus(426)
@@ -86,15 +110,11 @@ func GQL(app fiber.Router) {
 			})
 		}
 
-		var ip string
-		ips := c.IPs()
-		if len(ips) > 0 {
-			ip = ips[0]
-		} else {
-			ip = c.IP()
-		}
+		ctx := context.WithValue(context.Background(), utils.Key("ip"), ips.clientIP(c))
+		ctx = context.WithValue(ctx, utils.Key("voter_token"), voterToken(c))
+		ctx = context.WithValue(ctx, utils.Key("set_voter_token"), voterTokenCookie(c))
 
-		result := schema.Exec(context.WithValue(context.Background(), utils.Key("ip"), ip), req.Query, req.OperationName, req.Variables)
+		result := schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
 
 		status := 200
 
@@ -106,6 +126,11 @@ func GQL(app fiber.Router) {
 	})
 
 	gql.Get("/", websocket.New(func(c *websocket.Conn) {
+		if c.Subprotocol() != "" {
+			serveGraphQLWS(c, schema)
+			return
+		}
+
 		closeChan := make(chan struct{})
 		mtx := &sync.Mutex{}
 		closed := false
@@ -182,7 +207,7 @@ func GQL(app fiber.Router) {
 			}
 
 			go func() {
-				queryCtx, cancel := context.WithCancel(context.WithValue(context.Background(), utils.Key("ip"), c.Locals("ip")))
+				queryCtx, cancel := context.WithCancel(context.WithValue(context.WithValue(context.Background(), utils.Key("ip"), c.Locals("ip")), utils.Key("voter_token"), c.Locals("voter_token")))
 				result, err := schema.Subscribe(queryCtx, req.Query, req.OperationName, req.Variables)
 				if err != nil {
 					log.Errorf("gql, err=%v", err)
@@ -257,5 +282,7 @@ func GQL(app fiber.Router) {
 				}
 			}()
 		}
+	}, websocket.Config{
+		Subprotocols: []string{protocolTransportWS, protocolSubscriptionsWS},
 	}))
 }
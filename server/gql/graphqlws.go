@@ -0,0 +1,268 @@
+package gql
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/graph-gophers/graphql-go"
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// The websocket endpoint speaks graphql-transport-ws and the legacy subscriptions-transport-ws, picked by the client through
+// Sec-WebSocket-Protocol. Clients that ask for neither get the original request_id and sub_id protocol.
+const (
+	protocolTransportWS     = "graphql-transport-ws"
+	protocolSubscriptionsWS = "graphql-ws"
+)
+
+// Close codes of graphql-transport-ws.
+const (
+	closeBadRequest       = 4400
+	closeUnauthorized     = 4401
+	closeInitTimeout      = 4408
+	closeSubscriberExists = 4409
+	closeTooManyInits     = 4429
+)
+
+const (
+	wsInitTimeout = 10 * time.Second
+	wsKeepAlive   = 30 * time.Second
+)
+
+type wsMessage struct {
+	ID      string              `json:"id,omitempty"`
+	Type    string              `json:"type"`
+	Payload jsoniter.RawMessage `json:"payload,omitempty"`
+}
+
+type wsOutMessage struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+type wsSubscribePayload struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+type wsInitPayload struct {
+	VoterToken string `json:"voter_token"`
+}
+
+// graphqlWS serves one websocket connection speaking either graphql-transport-ws or, when legacy is set, subscriptions-transport-ws.
+type graphqlWS struct {
+	conn   *websocket.Conn
+	schema *graphql.Schema
+	legacy bool
+
+	mtx    sync.Mutex
+	subs   map[string]context.CancelFunc
+	acked  bool
+	closed bool
+}
+
+func serveGraphQLWS(c *websocket.Conn, schema *graphql.Schema) {
+	s := &graphqlWS{
+		conn:   c,
+		schema: schema,
+		legacy: c.Subprotocol() == protocolSubscriptionsWS,
+		subs:   map[string]context.CancelFunc{},
+	}
+	s.serve()
+}
+
+func (s *graphqlWS) write(msg wsOutMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("json, err=%v", err)
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return
+	}
+	if err = s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		s.closed = true
+	}
+}
+
+// close ends the connection with a close code, the read loop then stops on its next read.
+func (s *graphqlWS) close(code int, reason string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = s.conn.Close()
+}
+
+func (s *graphqlWS) serve() {
+	ctx, cancel := context.WithCancel(context.WithValue(context.WithValue(context.Background(), utils.Key("ip"), s.conn.Locals("ip")), utils.Key("voter_token"), s.conn.Locals("voter_token")))
+	defer cancel()
+	// subCtx is what subscriptions run with, connection_init can add the voter token to it.
+	// Only this loop touches it, the keep alive goroutine gets ctx itself.
+	subCtx := ctx
+
+	initTimer := time.AfterFunc(wsInitTimeout, func() {
+		s.mtx.Lock()
+		acked := s.acked
+		s.mtx.Unlock()
+		if !acked {
+			s.close(closeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+
+	go func(ctx context.Context) {
+		tick := time.NewTicker(wsKeepAlive)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if s.legacy {
+					s.write(wsOutMessage{Type: "ka"})
+				} else {
+					s.write(wsOutMessage{Type: "ping"})
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(ctx)
+
+	for {
+		mt, data, err := s.conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+
+		msg := wsMessage{}
+		if err = json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			s.close(closeBadRequest, "Invalid message received")
+			break
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			s.mtx.Lock()
+			acked := s.acked
+			s.acked = true
+			s.mtx.Unlock()
+			if acked {
+				s.close(closeTooManyInits, "Too many initialisation requests")
+				return
+			}
+			// Browsers cannot set headers on websockets, so the voter token can also be sent in the init payload.
+			if token, _ := subCtx.Value(utils.Key("voter_token")).(string); token == "" && len(msg.Payload) > 0 {
+				init := wsInitPayload{}
+				if err = json.Unmarshal(msg.Payload, &init); err == nil && init.VoterToken != "" {
+					subCtx = context.WithValue(subCtx, utils.Key("voter_token"), init.VoterToken)
+				}
+			}
+			s.write(wsOutMessage{Type: "connection_ack"})
+			if s.legacy {
+				s.write(wsOutMessage{Type: "ka"})
+			}
+		case "ping":
+			s.write(wsOutMessage{Type: "pong", Payload: msg.Payload})
+		case "pong":
+		case "subscribe", "start":
+			s.mtx.Lock()
+			acked := s.acked
+			s.mtx.Unlock()
+			if !acked {
+				s.close(closeUnauthorized, "Unauthorized")
+				return
+			}
+			s.subscribe(subCtx, msg)
+		case "complete", "stop":
+			s.mtx.Lock()
+			cancelSub, ok := s.subs[msg.ID]
+			delete(s.subs, msg.ID)
+			s.mtx.Unlock()
+			if ok {
+				cancelSub()
+				if s.legacy {
+					s.write(wsOutMessage{ID: msg.ID, Type: "complete"})
+				}
+			}
+		case "connection_terminate":
+			s.close(websocket.CloseNormalClosure, "")
+			return
+		default:
+			s.close(closeBadRequest, "Invalid message received")
+			return
+		}
+	}
+}
+
+func (s *graphqlWS) subscribe(ctx context.Context, msg wsMessage) {
+	payload := wsSubscribePayload{}
+	if msg.ID == "" || json.Unmarshal(msg.Payload, &payload) != nil {
+		s.close(closeBadRequest, "Invalid message received")
+		return
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	s.mtx.Lock()
+	if _, ok := s.subs[msg.ID]; ok {
+		s.mtx.Unlock()
+		cancel()
+		s.close(closeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+		return
+	}
+	s.subs[msg.ID] = cancel
+	s.mtx.Unlock()
+
+	next := "next"
+	if s.legacy {
+		next = "data"
+	}
+
+	go func() {
+		defer cancel()
+
+		results, err := s.schema.Subscribe(subCtx, payload.Query, payload.OperationName, payload.Variables)
+		if err != nil {
+			log.Errorf("gql, err=%v", err)
+			s.finish(msg.ID, wsOutMessage{ID: msg.ID, Type: "error", Payload: []map[string]string{{"message": "internal server error"}}})
+			return
+		}
+
+		first := true
+		for val := range results {
+			// A request that fails before producing any data, such as a validation error, is reported as an error message.
+			if res, ok := val.(*graphql.Response); ok && first && res.Data == nil && len(res.Errors) > 0 {
+				s.finish(msg.ID, wsOutMessage{ID: msg.ID, Type: "error", Payload: res.Errors})
+				return
+			}
+			first = false
+			s.write(wsOutMessage{ID: msg.ID, Type: next, Payload: val})
+		}
+
+		s.finish(msg.ID, wsOutMessage{ID: msg.ID, Type: "complete"})
+	}()
+}
+
+// finish sends the last message of a subscription, unless the client already completed it.
+func (s *graphqlWS) finish(id string, msg wsOutMessage) {
+	s.mtx.Lock()
+	_, ok := s.subs[id]
+	delete(s.subs, id)
+	s.mtx.Unlock()
+	if ok {
+		s.write(msg)
+	}
+}
@@ -0,0 +1,58 @@
+package gql
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// ipResolver finds the ip of the client behind any trusted proxies.
+// Forwarding headers are only read from trusted proxies, so clients cannot spoof their ip by sending them directly.
+type ipResolver struct {
+	trusted utils.Networks
+}
+
+func newIPResolver() *ipResolver {
+	trusted, err := utils.ParseNetworks(configure.Config.GetStringSlice("trusted_proxies"))
+	if err != nil {
+		panic(err)
+	}
+	return &ipResolver{trusted}
+}
+
+// clientIP walks the X-Forwarded-For chain from the right, each hop was appended by the proxy before it,
+// so the first hop that is not a trusted proxy is the client. X-Real-IP is used when there is no X-Forwarded-For.
+func (r *ipResolver) clientIP(c *fiber.Ctx) string {
+	remote := c.Context().RemoteIP()
+	if !r.trusted.Contains(remote) {
+		return remote.String()
+	}
+
+	if xff := c.Get(fiber.HeaderXForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+		var ip net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				// A malformed hop was not written by a trusted proxy, so the last valid hop is as far as the chain can be trusted.
+				break
+			}
+			ip = hop
+			if !r.trusted.Contains(hop) {
+				break
+			}
+		}
+		if ip != nil {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(c.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return remote.String()
+}
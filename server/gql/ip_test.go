@@ -0,0 +1,114 @@
+package gql
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := utils.ParseNetworks([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ipResolver{trusted}
+	app := fiber.New()
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		ip      string
+	}{
+		{
+			name:   "direct client",
+			remote: "203.0.113.7",
+			ip:     "203.0.113.7",
+		},
+		{
+			name:    "untrusted peer cannot forward",
+			remote:  "203.0.113.7",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "one trusted proxy",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "spoofed hops before the client are ignored",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, 192.0.2.2, 198.51.100.1"},
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "chain of trusted proxies",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1, 10.0.0.3, 10.0.0.2"},
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "spoofed trusted address before the client",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.9, 198.51.100.1"},
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "malformed hop stops the walk",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, not-an-ip, 10.0.0.2"},
+			ip:      "10.0.0.2",
+		},
+		{
+			name:    "malformed last hop",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, not-an-ip"},
+			ip:      "10.0.0.1",
+		},
+		{
+			name:    "every hop trusted",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			ip:      "10.0.0.3",
+		},
+		{
+			name:    "ipv6 hops",
+			remote:  "2001:db8::1",
+			headers: map[string]string{"X-Forwarded-For": "2001:db9::5, 2001:db8::2"},
+			ip:      "2001:db9::5",
+		},
+		{
+			name:    "x-real-ip without x-forwarded-for",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Real-IP": " 198.51.100.1 "},
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "invalid x-real-ip",
+			remote:  "10.0.0.1",
+			headers: map[string]string{"X-Real-IP": "not-an-ip"},
+			ip:      "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fctx := &fasthttp.RequestCtx{}
+			fctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 40000}, nil)
+			for k, v := range tt.headers {
+				fctx.Request.Header.Set(k, v)
+			}
+			c := app.AcquireCtx(fctx)
+			defer app.ReleaseCtx(c)
+
+			if ip := r.clientIP(c); ip != tt.ip {
+				t.Errorf("clientIP = %s, want %s", ip, tt.ip)
+			}
+		})
+	}
+}
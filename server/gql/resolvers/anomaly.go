@@ -0,0 +1,350 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ballots cast during a burst are flagged and quarantined, they are stored and counted in the quarantine hashes of the poll
+// but left out of the public tally and vote events until the owner reviews them in the integrity report and releases them.
+// Bursts are counted in fixed windows of redis counters, so the ballots before a limit is reached are not flagged.
+// Only ballots the vote script accepts are counted, so repeated or late votes cannot push other voters into quarantine.
+const (
+	// flagNetworkBurst marks a ballot from an ipv4 /24 or ipv6 /64 network that voted more than anomaly_network_limit times in anomaly_network_window seconds.
+	flagNetworkBurst = "NETWORK_BURST"
+	// flagOptionRate marks a ballot for an option that got more than anomaly_option_rate votes in a second.
+	flagOptionRate = "OPTION_RATE"
+)
+
+func anomalyNetworkLimit() int64 {
+	return int64(configure.Config.GetInt("anomaly_network_limit"))
+}
+
+func anomalyNetworkWindow() time.Duration {
+	if s := configure.Config.GetInt("anomaly_network_window"); s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func anomalyOptionRate() int64 {
+	return int64(configure.Config.GetInt("anomaly_option_rate"))
+}
+
+// ipNetwork returns the /24 network of an ipv4 address or the /64 network of an ipv6 address.
+func ipNetwork(ip string) string {
+	members, _ := ipPrefixDedup{}.members(voter{IP: ip})
+	if len(members) == 0 {
+		return ""
+	}
+	return members[0][len("net:"):]
+}
+
+// anomalyCounter is a burst counter a ballot goes towards, the vote script only increments it if it accepts the ballot.
+type anomalyCounter struct {
+	key    string
+	ttl    time.Duration
+	limit  int64
+	reason string
+}
+
+// detectAnomalies checks a ballot against the burst counters of its poll, returning the flags of every limit it would go over
+// and the counters to increment once the ballot is accepted. Ballots are not flagged if the counters cannot be read.
+func detectAnomalies(poll *mongo.Poll, ballot mongo.PollAnswer) ([]string, []anomalyCounter) {
+	now := time.Now()
+	counters := []anomalyCounter{}
+
+	network := ipNetwork(ballot.IP)
+	if limit := anomalyNetworkLimit(); limit > 0 && network != "" {
+		window := anomalyNetworkWindow()
+		key := fmt.Sprintf("anomaly:%s:net:%s:%d", poll.ID.Hex(), network, now.UnixNano()/int64(window))
+		counters = append(counters, anomalyCounter{key, window, limit, flagNetworkBurst})
+	}
+
+	// Score polls rate every option on every ballot, so only the options a ballot picks can show a rate anomaly.
+	if rate := anomalyOptionRate(); rate > 0 && pollType(poll) != pollTypeScore {
+		for _, o := range countedSelection(poll, ballot.Answer) {
+			key := fmt.Sprintf("anomaly:%s:option:%d:%d", poll.ID.Hex(), o, now.Unix())
+			counters = append(counters, anomalyCounter{key, 2 * time.Second, rate, flagOptionRate})
+		}
+	}
+
+	if len(counters) == 0 {
+		return nil, nil
+	}
+
+	pipe := redis.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(counters))
+	for i, c := range counters {
+		cmds[i] = pipe.Get(redis.Ctx, c.key)
+	}
+	if _, err := pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+		return nil, counters
+	}
+
+	flags := []string{}
+	flagged := map[string]bool{}
+	for i, c := range counters {
+		n, _ := cmds[i].Int64()
+		if n+1 > c.limit && !flagged[c.reason] {
+			flagged[c.reason] = true
+			flags = append(flags, c.reason)
+		}
+	}
+	if len(flags) == 0 {
+		return nil, counters
+	}
+	return flags, counters
+}
+
+// fetchLastRelease returns the seq of the last release entry in the ballot log of a poll, or -1 if its quarantine was never released.
+// Every quarantined ballot logged before a release entry was released into the public tally by it.
+func fetchLastRelease(id primitive.ObjectID) (int32, error) {
+	res := mongo.Database.Collection("pollanswers").FindOne(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"kind":    ballotKindRelease,
+	}, options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"seq": 1}))
+	entry := mongo.PollAnswer{}
+	err := res.Err()
+	if err == mongo.ErrNoDocuments {
+		return -1, nil
+	}
+	if err == nil {
+		err = res.Decode(&entry)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if entry.Seq == nil {
+		return -1, nil
+	}
+	return *entry.Seq, nil
+}
+
+// quarantined reports if a ballot is kept out of the public tally, given the seq of the last release entry of its poll.
+func quarantined(ballot mongo.PollAnswer, lastRelease int32) bool {
+	return len(ballot.Flags) > 0 && (ballot.Seq == nil || *ballot.Seq > lastRelease)
+}
+
+// quarantinedFilter matches the ballots of a poll still kept out of the public tally, see quarantined.
+func quarantinedFilter(id primitive.ObjectID, lastRelease int32) bson.M {
+	return bson.M{
+		"poll_id": id,
+		"flags":   bson.M{"$exists": true},
+		"$or": bson.A{
+			bson.M{"seq": bson.M{"$exists": false}},
+			bson.M{"seq": bson.M{"$gt": lastRelease}},
+		},
+	}
+}
+
+// releaseScript moves the quarantine hashes of a poll into its public tally, queues the release entry for the ballot log
+// behind the ballots it releases and publishes the public tally after the release. It returns the seq of the released event, or -1 if nothing was quarantined.
+//
+// KEYS: quarantine options hash, quarantine scores hash, options hash, scores hash, dirty tally set, ballot outbox, event seq counter, event stream
+// ARGV: poll id, release entry, released event channel, release time, event retention, event seq floor, event ttl
+var releaseScript = redis.NewScript(luaPublishEvent + `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+local function move(from, to)
+	local fields = redis.call("HGETALL", from)
+	for i = 1, #fields, 2 do
+		redis.call("HINCRBY", to, fields[i], fields[i + 1])
+	end
+	redis.call("DEL", from)
+end
+local function hash(key)
+	local fields = redis.call("HGETALL", key)
+	local t = {}
+	for i = 1, #fields, 2 do
+		t[fields[i]] = fields[i + 1]
+	end
+	return t
+end
+move(KEYS[1], KEYS[3])
+move(KEYS[2], KEYS[4])
+redis.call("SADD", KEYS[5], ARGV[1])
+redis.call("LPUSH", KEYS[6], ARGV[2])
+return publish_event(KEYS[7], KEYS[8], ARGV[3], "released", cjson.encode({at = ARGV[4], votes = hash(KEYS[3]), scores = hash(KEYS[4])}), ARGV[5], ARGV[6], ARGV[7])
+`)
+
+// ReleaseQuarantine moves every quarantined ballot of a poll into the public tally, once the owner reviewed them in the integrity report.
+// The release is written to the ballot log after the ballots it releases, so the log still accounts for the public tally.
+func (*RootResolver) ReleaseQuarantine(ctx context.Context, args ownerArgs) (string, error) {
+	poll, state, err := fetchOwnedPoll(args, nil)
+	if err != nil || state != "" {
+		return state, err
+	}
+
+	entry := mongo.PollAnswer{
+		ID:     primitive.NewObjectID(),
+		PollID: poll.ID,
+		Answer: []int32{},
+		Kind:   ballotKindRelease,
+	}
+	entry.Digest = releaseDigest(entry)
+	entryStr, err := json.MarshalToString(entry)
+	if err != nil {
+		log.Errorf("json, err=%v", err)
+		return "", errInternalServer
+	}
+
+	hex := poll.ID.Hex()
+	seq, err := releaseScript.Run(redis.Ctx, redis.Client, []string{
+		fmt.Sprintf("poll:votes:%s:quarantine:options", hex),
+		fmt.Sprintf("poll:votes:%s:quarantine:scores", hex),
+		fmt.Sprintf("poll:votes:%s:options", hex),
+		fmt.Sprintf("poll:votes:%s:scores", hex),
+		tallyDirty,
+		outboxBallots,
+		eventSeqKey(poll.ID),
+		eventStreamKey(poll.ID),
+	}, hex, entryStr, fmt.Sprintf("events:poll:released:%s", hex), time.Now().Format(time.RFC3339Nano), eventRetention(), poll.EventSeq, eventExpiry(poll.Closed)).Int64()
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return "", errInternalServer
+	}
+	if seq > 0 && poll.Closed {
+		keepEventSeq(poll.ID, seq)
+	}
+
+	return "SUCCESS", nil
+}
+
+type integrityReport struct {
+	Ballots     int32
+	Quarantined int32
+	Flags       []integrityFlag
+	Networks    []integrityNetwork
+	Options     []integrityOption
+}
+
+type integrityFlag struct {
+	Reason  string
+	Ballots int32
+}
+
+type integrityNetwork struct {
+	Network string
+	Ballots int32
+}
+
+type integrityOption struct {
+	Title       string
+	Votes       int32
+	Quarantined int32
+}
+
+// integrityNetworkCount is the number of networks with the most quarantined ballots listed in the report.
+const integrityNetworkCount = 20
+
+// IntegrityReport lists the quarantined ballots of a poll, so the owner can review them before announcing a winner.
+func (*RootResolver) IntegrityReport(ctx context.Context, args ownerArgs) (*integrityReport, error) {
+	poll, state, err := fetchOwnedPoll(args, nil)
+	if err != nil || state != "" {
+		return nil, err
+	}
+
+	total, err := mongo.Database.Collection("pollanswers").CountDocuments(mongo.Ctx, bson.M{
+		"poll_id": poll.ID,
+		"kind":    bson.M{"$exists": false},
+	})
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	lastRelease, err := fetchLastRelease(poll.ID)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, quarantinedFilter(poll.ID, lastRelease),
+		options.Find().SetProjection(bson.M{"ip": 1, "flags": 1}))
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+	flagged := []mongo.PollAnswer{}
+	if err = cur.All(mongo.Ctx, &flagged); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	report := &integrityReport{
+		Ballots:     int32(total) - int32(len(flagged)),
+		Quarantined: int32(len(flagged)),
+		Flags:       []integrityFlag{},
+		Networks:    []integrityNetwork{},
+	}
+
+	reasons := map[string]int32{}
+	networks := map[string]int32{}
+	for _, a := range flagged {
+		for _, f := range a.Flags {
+			reasons[f]++
+		}
+		if n := ipNetwork(a.IP); n != "" {
+			networks[n]++
+		}
+	}
+	for _, reason := range []string{flagNetworkBurst, flagOptionRate} {
+		if v, ok := reasons[reason]; ok {
+			report.Flags = append(report.Flags, integrityFlag{reason, v})
+		}
+	}
+	for n, v := range networks {
+		report.Networks = append(report.Networks, integrityNetwork{n, v})
+	}
+	sort.Slice(report.Networks, func(i, j int) bool {
+		a, b := report.Networks[i], report.Networks[j]
+		return a.Ballots > b.Ballots || a.Ballots == b.Ballots && a.Network < b.Network
+	})
+	if len(report.Networks) > integrityNetworkCount {
+		report.Networks = report.Networks[:integrityNetworkCount]
+	}
+
+	votes, _, err := fetchTally(poll.ID)
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return nil, errInternalServer
+	}
+	quarantined, _, err := fetchQuarantine(poll.ID)
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return nil, errInternalServer
+	}
+	report.Options = make([]integrityOption, len(poll.OptionsRaw))
+	for i, title := range poll.OptionsRaw {
+		v, _ := strconv.Atoi(votes[strconv.Itoa(i)])
+		q, _ := strconv.Atoi(quarantined[strconv.Itoa(i)])
+		report.Options[i] = integrityOption{title, int32(v), int32(q)}
+	}
+
+	return report, nil
+}
+
+// fetchQuarantine reads the quarantined options and scores vote hashes of a poll.
+func fetchQuarantine(id primitive.ObjectID) (map[string]string, map[string]string, error) {
+	pipe := redis.Client.Pipeline()
+	votesCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:quarantine:options", id.Hex()))
+	scoresCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:quarantine:scores", id.Hex()))
+	if _, err := pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		return nil, nil, err
+	}
+	return votesCmd.Val(), scoresCmd.Val(), nil
+}
@@ -0,0 +1,344 @@
+package resolvers
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Ballots are counted in redis first and queued on the ballot outbox in the same script,
+// the lifecycle worker then moves them into mongo and retries until they land.
+const (
+	outboxBallots    = "outbox:pollanswers"
+	outboxProcessing = "outbox:pollanswers:processing"
+	outboxBatch      = 1000
+)
+
+// voteScript counts a ballot atomically, either every step of a vote happens or none does.
+//
+// It returns the result state, followed by the ballot receipt on success. With an idempotency key the result is stored under it,
+// and a retry returns the stored result without voting again.
+// Quarantined ballots are counted in the quarantine hashes instead and publish no vote event.
+//
+// KEYS: dedup set, options hash, scores hash, dirty tally set, ballot outbox, idempotency key, event seq counter, event stream,
+// closed marker, then the anomaly counters the ballot goes towards
+// ARGV: json array of the dedup members of the voter, opens at and expiry in unix ms or 0, vote event channel or empty to publish nothing, vote event payload, ballot,
+// poll id, number of options hash increments, idempotency key ttl in ms or 0 without a key, ballot receipt, event retention,
+// json array of the ttl in ms of each anomaly counter, then the options hash and scores hash increments as field and value pairs.
+var voteScript = redis.NewScript(luaPublishEvent + `
+redis.replicate_commands()
+local ttl = tonumber(ARGV[9])
+if ttl > 0 then
+	local prev = redis.call("GET", KEYS[6])
+	if prev then
+		return prev
+	end
+end
+local function finish(state)
+	if ttl > 0 then
+		redis.call("SET", KEYS[6], state, "PX", ttl)
+	end
+	return state
+end
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local opens = tonumber(ARGV[2])
+if opens > 0 and now < opens then
+	return finish("NOT_OPEN_YET")
+end
+local expiry = tonumber(ARGV[3])
+if expiry > 0 and now >= expiry then
+	return finish("EXPIRED")
+end
+if redis.call("EXISTS", KEYS[9]) == 1 then
+	return finish("CLOSED")
+end
+local members = cjson.decode(ARGV[1])
+for _, m in ipairs(members) do
+	if redis.call("SISMEMBER", KEYS[1], m) == 1 then
+		return finish("ALREADY_VOTED")
+	end
+end
+for _, m in ipairs(members) do
+	redis.call("SADD", KEYS[1], m)
+end
+for k, ttl in ipairs(cjson.decode(ARGV[12])) do
+	redis.call("INCR", KEYS[9 + k])
+	redis.call("PEXPIRE", KEYS[9 + k], ttl)
+end
+local i = 13
+for _ = 1, tonumber(ARGV[8]) do
+	redis.call("HINCRBY", KEYS[2], ARGV[i], ARGV[i + 1])
+	i = i + 2
+end
+while i < #ARGV do
+	redis.call("HINCRBY", KEYS[3], ARGV[i], ARGV[i + 1])
+	i = i + 2
+end
+redis.call("SADD", KEYS[4], ARGV[7])
+redis.call("LPUSH", KEYS[5], ARGV[6])
+if ARGV[4] ~= "" then
+	publish_event(KEYS[7], KEYS[8], ARGV[4], "vote", ARGV[5], ARGV[11], 0, 0)
+end
+return finish("SUCCESS " .. ARGV[10])
+`)
+
+func unixMillis(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// castBallot counts a ballot that already passed validation, returning the result of the vote script.
+// The voter members of the ballot are added to the poll's dedup set, the set keeps its original ips name as ip dedup members are bare ips.
+// Flagged ballots are quarantined, they are kept out of the public tally and vote events.
+// counters are the anomaly counters the ballot goes towards if it is accepted.
+// idempotency is the key the result state is stored under, or empty without an idempotency key.
+func castBallot(poll *mongo.Poll, ballot mongo.PollAnswer, counters []anomalyCounter, idempotency string) (string, error) {
+	members := ballot.Voter
+	if members == nil {
+		members = []string{}
+	}
+	membersStr, err := json.MarshalToString(members)
+	if err != nil {
+		return "", err
+	}
+	selectionStr, err := json.MarshalToString(ballot.Answer)
+	if err != nil {
+		return "", err
+	}
+	ballotStr, err := json.MarshalToString(ballot)
+	if err != nil {
+		return "", err
+	}
+
+	options, scores := tallyIncrements(poll, ballot.Answer)
+
+	var ttl int64
+	if idempotency != "" {
+		ttl = idempotencyTTL().Milliseconds()
+	}
+
+	event := fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex())
+	optionsKey := fmt.Sprintf("poll:votes:%s:options", poll.ID.Hex())
+	scoresKey := fmt.Sprintf("poll:votes:%s:scores", poll.ID.Hex())
+	if len(ballot.Flags) > 0 {
+		event = ""
+		optionsKey = fmt.Sprintf("poll:votes:%s:quarantine:options", poll.ID.Hex())
+		scoresKey = fmt.Sprintf("poll:votes:%s:quarantine:scores", poll.ID.Hex())
+	}
+
+	ttls := make([]int64, len(counters))
+	for i, c := range counters {
+		ttls[i] = c.ttl.Milliseconds()
+	}
+	ttlsStr, err := json.MarshalToString(ttls)
+	if err != nil {
+		return "", err
+	}
+
+	args := make([]interface{}, 0, 12+2*(len(options)+len(scores)))
+	args = append(args,
+		membersStr,
+		unixMillis(poll.OpensAt),
+		unixMillis(poll.Expiry),
+		event,
+		selectionStr,
+		ballotStr,
+		poll.ID.Hex(),
+		len(options),
+		ttl,
+		fmt.Sprintf("%s %s", ballot.ID.Hex(), ballot.Digest),
+		eventRetention(),
+		ttlsStr,
+	)
+	for f, v := range options {
+		args = append(args, f, v)
+	}
+	for f, v := range scores {
+		args = append(args, f, v)
+	}
+
+	keys := []string{
+		fmt.Sprintf("poll:votes:%s:ips", poll.ID.Hex()),
+		optionsKey,
+		scoresKey,
+		tallyDirty,
+		outboxBallots,
+		idempotency,
+		eventSeqKey(poll.ID),
+		eventStreamKey(poll.ID),
+		closedMarkerKey(poll.ID),
+	}
+	for _, c := range counters {
+		keys = append(keys, c.key)
+	}
+
+	return voteScript.Run(redis.Ctx, redis.Client, keys, args...).Text()
+}
+
+// purgeOutboxScript removes the queued ballots of a poll from the given outbox lists and returns how many it removed.
+// ARGV: poll id
+var purgeOutboxScript = redis.NewScript(`
+local purged = 0
+for _, key in ipairs(KEYS) do
+	for _, val in ipairs(redis.call("LRANGE", key, 0, -1)) do
+		local ok, ballot = pcall(cjson.decode, val)
+		if ok and ballot.poll_id == ARGV[1] then
+			purged = purged + redis.call("LREM", key, 1, val)
+		end
+	end
+end
+return purged
+`)
+
+// purgeOutbox drops the queued ballots of a deleted poll, so the lifecycle worker does not write them after the poll is gone.
+func purgeOutbox(id primitive.ObjectID) error {
+	return purgeOutboxScript.Run(redis.Ctx, redis.Client, []string{outboxBallots, outboxProcessing}, id.Hex()).Err()
+}
+
+// existingPolls returns which of the given polls still exist.
+func existingPolls(ids []primitive.ObjectID) (map[primitive.ObjectID]bool, error) {
+	cur, err := mongo.Database.Collection("polls").Find(mongo.Ctx, bson.M{
+		"_id": bson.M{"$in": ids},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	polls := []mongo.Poll{}
+	if err = cur.All(mongo.Ctx, &polls); err != nil {
+		return nil, err
+	}
+	found := make(map[primitive.ObjectID]bool, len(polls))
+	for _, p := range polls {
+		found[p.ID] = true
+	}
+	return found, nil
+}
+
+// pendingBallots returns the entries of a poll still queued on the outbox, oldest first, both ballots and release entries.
+// Both outbox lists are read at once so an entry the lifecycle worker moves between them is seen exactly once.
+func pendingBallots(id primitive.ObjectID) ([]mongo.PollAnswer, error) {
+	pipe := redis.Client.TxPipeline()
+	processingCmd := pipe.LRange(redis.Ctx, outboxProcessing, 0, -1)
+	queuedCmd := pipe.LRange(redis.Ctx, outboxBallots, 0, -1)
+	if _, err := pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	// Entries are pushed on the left and taken from the right onto the processing list, so read backwards the processing list comes first.
+	vals := append(queuedCmd.Val(), processingCmd.Val()...)
+	pending := []mongo.PollAnswer{}
+	for i := len(vals) - 1; i >= 0; i-- {
+		entry := mongo.PollAnswer{}
+		if err := json.UnmarshalFromString(vals[i], &entry); err != nil || entry.PollID != id {
+			continue
+		}
+		pending = append(pending, entry)
+	}
+	return pending, nil
+}
+
+// recoverOutbox requeues ballots a previous lifecycle leader was writing when it stopped.
+func recoverOutbox() {
+	for {
+		err := redis.Client.RPopLPush(redis.Ctx, outboxProcessing, outboxBallots).Err()
+		if err == redis.ErrNil {
+			return
+		}
+		if err != nil {
+			log.Errorf("redis, err=%v", err)
+			return
+		}
+	}
+}
+
+// drainOutbox writes queued ballots into mongo, a ballot stays queued until the write succeeds.
+// Ballots are written in one batch per poll, a poll whose batch fails is retried from the first ballot that was not written.
+func drainOutbox() {
+	evictIdleLedgerHeads(time.Now())
+
+	vals := []string{}
+	for len(vals) < outboxBatch {
+		val, err := redis.Client.RPopLPush(redis.Ctx, outboxBallots, outboxProcessing).Result()
+		if err == redis.ErrNil {
+			break
+		}
+		if err != nil {
+			log.Errorf("redis, err=%v", err)
+			break
+		}
+		vals = append(vals, val)
+	}
+
+	polls := []primitive.ObjectID{}
+	batches := map[primitive.ObjectID][]*mongo.PollAnswer{}
+	batchVals := map[primitive.ObjectID][]string{}
+	for _, val := range vals {
+		ballot := &mongo.PollAnswer{}
+		if err := json.UnmarshalFromString(val, ballot); err != nil {
+			log.Errorf("outbox, dropping ballot=%s err=%v", val, err)
+			if err = redis.Client.LRem(redis.Ctx, outboxProcessing, 1, val).Err(); err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+			continue
+		}
+		if _, ok := batches[ballot.PollID]; !ok {
+			polls = append(polls, ballot.PollID)
+		}
+		batches[ballot.PollID] = append(batches[ballot.PollID], ballot)
+		batchVals[ballot.PollID] = append(batchVals[ballot.PollID], val)
+	}
+
+	if len(polls) == 0 {
+		return
+	}
+	// Without the lookup every poll is taken to exist, its ballots are dropped by the next run instead.
+	found, err := existingPolls(polls)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+	}
+
+	for _, id := range polls {
+		if found != nil && !found[id] {
+			// The poll was deleted while its ballots were queued, writing them would leave them behind in the ballot log.
+			log.Warnf("outbox, dropping %d ballots of deleted poll=%s", len(batchVals[id]), id.Hex())
+			pipe := redis.Client.TxPipeline()
+			for _, val := range batchVals[id] {
+				pipe.LRem(redis.Ctx, outboxProcessing, 1, val)
+			}
+			if _, err = pipe.Exec(redis.Ctx); err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+			continue
+		}
+
+		done, err := appendToLedger(id, batches[id])
+		if err != nil {
+			log.Errorf("ledger, err=%v", err)
+		}
+
+		pipe := redis.Client.TxPipeline()
+		retry := []string{}
+		for i, val := range batchVals[id] {
+			pipe.LRem(redis.Ctx, outboxProcessing, 1, val)
+			if !done[i] {
+				retry = append(retry, val)
+			}
+		}
+		// Put the ballots that were not written back at the end they are read from, in the order they were read, and wait for the next run.
+		for i := len(retry) - 1; i >= 0; i-- {
+			pipe.RPush(redis.Ctx, outboxBallots, retry[i])
+		}
+		if _, err = pipe.Exec(redis.Ctx); err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+const (
+	dedupNone       = "NONE"
+	dedupIP         = "IP"
+	dedupIPPrefix   = "IP_PREFIX"
+	dedupToken      = "TOKEN"
+	dedupIPAndToken = "IP_AND_TOKEN"
+)
+
+// voter identifies who cast a ballot.
+type voter struct {
+	IP string
+	// TokenID is the id of a valid voter token, empty if the request carried no valid token.
+	TokenID string
+}
+
+// A dedupStrategy decides which members a voter is recorded under in the dedup set of a poll,
+// a voter is turned away if any of its members are already in the set.
+type dedupStrategy interface {
+	// members returns the members of a voter, or the failing result state if the voter cannot be identified.
+	members(v voter) ([]string, string)
+	// usesIP reports if the strategy identifies voters by their ip.
+	usesIP() bool
+}
+
+var dedupStrategies = map[string]dedupStrategy{
+	dedupNone:       noDedup{},
+	dedupIP:         ipDedup{},
+	dedupIPPrefix:   ipPrefixDedup{},
+	dedupToken:      tokenDedup{},
+	dedupIPAndToken: allDedup{ipDedup{}, tokenDedup{}},
+}
+
+// pollDedupMode returns the dedup mode of a poll, polls created before dedup modes existed fall back to their check ip flag.
+func pollDedupMode(poll *mongo.Poll) string {
+	if poll.DedupMode != "" {
+		return poll.DedupMode
+	}
+	if poll.CheckIP {
+		return dedupIP
+	}
+	return dedupNone
+}
+
+func draftDedupMode(draft *mongo.Draft) string {
+	if draft.DedupMode != "" {
+		return draft.DedupMode
+	}
+	if draft.CheckIP {
+		return dedupIP
+	}
+	return dedupNone
+}
+
+// inputDedupMode resolves the dedup mode of a poll or draft input, check_ip is shorthand for IP.
+func inputDedupMode(in newInput) string {
+	if in.DedupMode != nil {
+		return *in.DedupMode
+	}
+	if in.CheckIP != nil && *in.CheckIP {
+		return dedupIP
+	}
+	return dedupNone
+}
+
+type noDedup struct{}
+
+func (noDedup) members(voter) ([]string, string) {
+	return nil, ""
+}
+
+func (noDedup) usesIP() bool {
+	return false
+}
+
+// ipDedup records voters by their exact ip, the members are bare ips so polls from before dedup modes keep their sets.
+type ipDedup struct{}
+
+func (ipDedup) members(v voter) ([]string, string) {
+	if v.IP == "" {
+		return nil, "UNKNOWN_VOTER"
+	}
+	return []string{v.IP}, ""
+}
+
+func (ipDedup) usesIP() bool {
+	return true
+}
+
+// ipPrefixDedup records voters by the /24 network of an ipv4 address or the /64 network of an ipv6 address.
+type ipPrefixDedup struct{}
+
+func (ipPrefixDedup) members(v voter) ([]string, string) {
+	if v.IP == "" {
+		return nil, "UNKNOWN_VOTER"
+	}
+	ip := net.ParseIP(v.IP)
+	if ip == nil {
+		return []string{"net:" + v.IP}, ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return []string{fmt.Sprintf("net:%s/24", ip4.Mask(net.CIDRMask(24, 32)))}, ""
+	}
+	return []string{fmt.Sprintf("net:%s/64", ip.Mask(net.CIDRMask(64, 128)))}, ""
+}
+
+func (ipPrefixDedup) usesIP() bool {
+	return true
+}
+
+// tokenDedup records voters by their signed voter token. Tokens are free to get, so on its own it only stops a voter from voting
+// twice as long as they keep their token, the voter_token rate limit is what bounds how many votes one ip can cast.
+type tokenDedup struct{}
+
+func (tokenDedup) members(v voter) ([]string, string) {
+	if v.TokenID == "" {
+		return nil, "VOTER_TOKEN_REQUIRED"
+	}
+	return []string{"token:" + v.TokenID}, ""
+}
+
+func (tokenDedup) usesIP() bool {
+	return false
+}
+
+// allDedup records voters under the members of every strategy, so a voter matching any of them is turned away.
+type allDedup []dedupStrategy
+
+func (s allDedup) members(v voter) ([]string, string) {
+	members := []string{}
+	for _, d := range s {
+		m, state := d.members(v)
+		if state != "" {
+			return nil, state
+		}
+		members = append(members, m...)
+	}
+	return members, ""
+}
+
+func (s allDedup) usesIP() bool {
+	for _, d := range s {
+		if d.usesIP() {
+			return true
+		}
+	}
+	return false
+}
+
+// Voter tokens are a random id and an hmac of it keyed by voter_token_secret, so only this server can issue them.
+func voterTokenSecret() []byte {
+	return utils.S2B(configure.Config.GetString("voter_token_secret"))
+}
+
+func signVoterToken(id string) string {
+	mac := hmac.New(sha256.New, voterTokenSecret())
+	mac.Write(utils.S2B(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyVoterToken returns the id of a voter token, or an empty string if the token is not valid.
+func verifyVoterToken(token string) string {
+	if len(voterTokenSecret()) == 0 {
+		return ""
+	}
+	i := strings.IndexByte(token, '.')
+	if i == -1 {
+		return ""
+	}
+	id, sig := token[:i], token[i+1:]
+	if !hmac.Equal(utils.S2B(sig), utils.S2B(signVoterToken(id))) {
+		return ""
+	}
+	return id
+}
+
+// voterFromContext identifies the voter of a request.
+func voterFromContext(ctx context.Context) voter {
+	v := voter{IP: requestIP(ctx)}
+	if token := ctx.Value(utils.Key("voter_token")); token != nil {
+		v.TokenID = verifyVoterToken(token.(string))
+	}
+	return v
+}
+
+// VoterToken issues a new voter token.
+func (*RootResolver) VoterToken(ctx context.Context) (string, error) {
+	if len(voterTokenSecret()) == 0 {
+		return "", fmt.Errorf("voter tokens are not enabled")
+	}
+
+	if wait := rateLimited("voter_token", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return "", rateLimitedError{wait}
+	}
+
+	id, err := utils.GenerateRandomString(18)
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return "", errInternalServer
+	}
+
+	token := id + "." + signVoterToken(id)
+	// Only plain http requests can set the cookie, websocket clients send the token themselves.
+	if set, ok := ctx.Value(utils.Key("set_voter_token")).(func(string)); ok {
+		set(token)
+	}
+	return token, nil
+}
@@ -0,0 +1,156 @@
+package resolvers
+
+import (
+	"context"
+
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+)
+
+// pollDelta is a frame of watchDelta, the first frame is a snapshot of the poll and every frame after it
+// only carries what changed since the frame before.
+type pollDelta struct {
+	Seq      int32
+	Snapshot *pollResolver
+	Options  *[]optionDelta
+	Status   *string
+	Watchers *int32
+}
+
+type optionDelta struct {
+	Index     int32
+	Votes     int32
+	Count     int32
+	Average   *float64
+	Histogram *[]int32
+}
+
+// deltaField returns the fields watchDelta needs watched, those selected on the snapshot along with every count of the options
+// and the watchers.
+func deltaField(snapshot *selectedField) *selectedField {
+	field := &selectedField{
+		name:     "snapshot",
+		children: map[string]*selectedField{},
+	}
+	if snapshot != nil {
+		for k, v := range snapshot.children {
+			field.children[k] = v
+		}
+	}
+	options := &selectedField{
+		name:     "options",
+		children: map[string]*selectedField{},
+	}
+	if v, ok := field.children["options"]; ok {
+		for k, c := range v.children {
+			options.children[k] = c
+		}
+	}
+	for _, f := range []string{"votes", "count", "average", "histogram"} {
+		options.children[f] = &selectedField{name: f}
+	}
+	field.children["options"] = options
+	field.children["watchers"] = &selectedField{name: "watchers"}
+	return field
+}
+
+// diffOptions returns the options whose counts differ between two frames of a poll.
+func diffOptions(prev []mongo.PollOption, cur []mongo.PollOption) []optionDelta {
+	changed := []optionDelta{}
+	for i, o := range cur {
+		if i < len(prev) && !optionChanged(prev[i], o) {
+			continue
+		}
+		changed = append(changed, optionDelta{
+			Index:     int32(i),
+			Votes:     o.Votes,
+			Count:     o.Count,
+			Average:   o.Average,
+			Histogram: o.Histogram,
+		})
+	}
+	return changed
+}
+
+func optionChanged(a mongo.PollOption, b mongo.PollOption) bool {
+	if a.Votes != b.Votes || a.Count != b.Count {
+		return true
+	}
+	if (a.Average == nil) != (b.Average == nil) || a.Average != nil && *a.Average != *b.Average {
+		return true
+	}
+	if (a.Histogram == nil) != (b.Histogram == nil) {
+		return true
+	}
+	if a.Histogram != nil {
+		if len(*a.Histogram) != len(*b.Histogram) {
+			return true
+		}
+		for i, v := range *a.Histogram {
+			if (*b.Histogram)[i] != v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WatchDelta watches a poll like Watch, but after the first frame only sends the option counts, status and watchers that changed.
+func (r *RootResolver) WatchDelta(ctx context.Context, args watchArgs) (<-chan *pollDelta, error) {
+	snapshot := generateSelectedFieldMap(ctx).children["snapshot"]
+
+	frames, err := r.watch(ctx, args, deltaField(snapshot))
+	if err != nil {
+		return nil, err
+	}
+
+	dChan := make(chan *pollDelta, 1)
+	go func() {
+		defer close(dChan)
+
+		var prev *mongo.Poll
+		var prevStatus string
+		seq := int32(0)
+		for {
+			var frame *pollResolver
+			select {
+			case f, ok := <-frames:
+				if !ok {
+					return
+				}
+				frame = f
+			case <-ctx.Done():
+				return
+			}
+
+			status := pollStatus(frame.poll)
+			delta := &pollDelta{Seq: seq}
+			if prev == nil {
+				delta.Snapshot = &pollResolver{frame.poll, snapshot}
+			} else {
+				options := diffOptions(*prev.Options, *frame.poll.Options)
+				if len(options) > 0 {
+					delta.Options = &options
+				}
+				if status != prevStatus {
+					delta.Status = &status
+				}
+				if prev.Watchers != nil && frame.poll.Watchers != nil && *prev.Watchers != *frame.poll.Watchers {
+					delta.Watchers = frame.poll.Watchers
+				}
+				if delta.Options == nil && delta.Status == nil && delta.Watchers == nil {
+					continue
+				}
+			}
+			prev, prevStatus = frame.poll, status
+			seq++
+
+			select {
+			case dChan <- delta:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return dChan, nil
+}
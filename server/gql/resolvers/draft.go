@@ -0,0 +1,261 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/challenge"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fetchOwnedDraft fetches a draft and checks the admin token against it, returning the failing result state if the draft is missing or the token does not match.
+func fetchOwnedDraft(args ownerArgs) (*mongo.Draft, string, error) {
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		return nil, "MISSING_DRAFT", nil
+	}
+
+	draft, err := fetchDraft(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if draft == nil {
+		return nil, "MISSING_DRAFT", nil
+	}
+
+	if !tokenMatches(draft.AdminTokenHash, args.AdminToken) {
+		return nil, "INVALID_TOKEN", nil
+	}
+
+	return draft, "", nil
+}
+
+func invalidateDraft(id primitive.ObjectID) {
+	if err := redis.Client.Del(redis.Ctx, fmt.Sprintf("cached:drafts:%s", id.Hex())).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+// PublishDraft creates a new poll from a draft, a draft can be published any number of times.
+// Drafts created before admin tokens existed have no token that matches, so they cannot be published.
+func (*RootResolver) PublishDraft(ctx context.Context, args struct {
+	ID             string
+	AdminToken     string
+	ChallengeToken *string
+}) (result, error) {
+	// Publishing creates a poll, so it counts against the same budget as new.
+	if wait := rateLimited("new", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return result{"RATE_LIMITED", nil, nil, retryAfter(wait)}, nil
+	}
+
+	draft, state, err := fetchOwnedDraft(ownerArgs{args.ID, args.AdminToken})
+	if err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	// Publishing creates a poll, so it needs the same verification as creating one with new.
+	if state, err := checkChallenge(ctx, challenge.Required(), args.ChallengeToken); err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	poll := pollFromDraft(draft)
+
+	token, err := createPoll(poll)
+	if err != nil {
+		return result{}, err
+	}
+
+	if _, err = mongo.Database.Collection("drafts").UpdateOne(mongo.Ctx, bson.M{
+		"_id": draft.ID,
+	}, bson.M{
+		"$set": bson.M{
+			"last_poll_id": poll.ID,
+		},
+		"$inc": bson.M{
+			"published": 1,
+		},
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+	} else {
+		invalidateDraft(draft.ID)
+	}
+
+	field := generateSelectedFieldMap(ctx)
+
+	return result{"SUCCESS", &pollResolver{poll, field.children["poll"]}, &token, nil}, nil
+}
+
+// pollFromDraft builds a new poll from a draft, the relative opening and expiry of the draft start counting now.
+func pollFromDraft(draft *mongo.Draft) *mongo.Poll {
+	typ := draft.Type
+	if typ == "" {
+		typ = pollTypeStandard
+	}
+
+	poll := &mongo.Poll{
+		Title:            draft.Title,
+		Type:             typ,
+		OptionsRaw:       draft.Options,
+		CheckIP:          draft.CheckIP,
+		DedupMode:        draftDedupMode(draft),
+		RequireChallenge: draft.RequireChallenge,
+		ScoreMin:         draft.ScoreMin,
+		ScoreMax:         draft.ScoreMax,
+		DraftID:          &draft.ID,
+	}
+	poll.MinSelections, poll.MaxSelections = selectionBounds(typ, draft.MultiAnswer, draft.MinSelections, draft.MaxSelections, len(draft.Options))
+
+	now := time.Now()
+	if draft.Expiry != nil && *draft.Expiry > 0 {
+		exp := now.Add(time.Duration(*draft.Expiry) * time.Second)
+		poll.Expiry = &exp
+	}
+	if draft.OpensAt != nil && *draft.OpensAt > 0 {
+		opens := now.Add(time.Duration(*draft.OpensAt) * time.Second)
+		poll.OpensAt = &opens
+	}
+
+	return poll
+}
+
+// UpdateDraft replaces the content of a draft, the replaced version is kept in the draft history.
+func (*RootResolver) UpdateDraft(ctx context.Context, args struct {
+	ID         string
+	AdminToken string
+	Poll       newInput
+}) (resultDraft, error) {
+	draft, state, err := fetchOwnedDraft(ownerArgs{args.ID, args.AdminToken})
+	if err != nil || state != "" {
+		return resultDraft{state, nil, nil, nil}, err
+	}
+
+	if state := validateNewInput(args.Poll); state != "" {
+		return resultDraft{state, nil, nil, nil}, nil
+	}
+
+	update := draftFromInput(args.Poll)
+	now := time.Now()
+
+	// The update only applies to the version it was based on, so concurrent edits each replace a version of their own.
+	// Drafts from before versions existed have none and are version 1.
+	prev := *draft
+	for {
+		filter := bson.M{
+			"_id":     draft.ID,
+			"version": prev.Version,
+		}
+		if prev.Version == 0 {
+			filter["version"] = bson.M{"$in": bson.A{nil, 0}}
+			prev.Version = 1
+		}
+
+		res := mongo.Database.Collection("drafts").FindOneAndUpdate(mongo.Ctx, filter, bson.M{
+			"$set": bson.M{
+				"title":             update.Title,
+				"type":              update.Type,
+				"options":           update.Options,
+				"check_ip":          update.CheckIP,
+				"dedup_mode":        update.DedupMode,
+				"require_challenge": update.RequireChallenge,
+				"multi_answer":      false,
+				"min_selections":    update.MinSelections,
+				"max_selections":    update.MaxSelections,
+				"score_min":         update.ScoreMin,
+				"score_max":         update.ScoreMax,
+				"opens_at":          update.OpensAt,
+				"expiry":            update.Expiry,
+				"updated_at":        now,
+				"version":           prev.Version + 1,
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.Before))
+
+		// The document before the update is the version being replaced.
+		version := prev.Version
+		err = res.Err()
+		if err == nil {
+			err = res.Decode(&prev)
+		}
+		if err == nil {
+			prev.Version = version
+			break
+		}
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("mongo, err=%v", err)
+			return resultDraft{}, errInternalServer
+		}
+
+		// Another edit replaced the version first, the update is applied on top of it instead.
+		res = mongo.Database.Collection("drafts").FindOne(mongo.Ctx, bson.M{
+			"_id": draft.ID,
+		})
+		prev = mongo.Draft{}
+		err = res.Err()
+		if err == mongo.ErrNoDocuments {
+			return resultDraft{"MISSING_DRAFT", nil, nil, nil}, nil
+		}
+		if err == nil {
+			err = res.Decode(&prev)
+		}
+		if err != nil {
+			log.Errorf("mongo, err=%v", err)
+			return resultDraft{}, errInternalServer
+		}
+	}
+
+	invalidateDraft(draft.ID)
+	if _, err = mongo.Database.Collection("draftversions").InsertOne(mongo.Ctx, mongo.DraftVersion{
+		DraftID:    draft.ID,
+		Version:    prev.Version,
+		ReplacedAt: now,
+		Draft:      prev,
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+	}
+
+	update.ID = draft.ID
+	update.Version = prev.Version + 1
+	update.UpdatedAt = &now
+	update.Published = prev.Published
+	update.LastPollID = prev.LastPollID
+
+	return resultDraft{"SUCCESS", &draftResolver{update}, nil, nil}, nil
+}
+
+// DraftHistory returns every version of a draft, oldest first and ending with the current version.
+func (*RootResolver) DraftHistory(ctx context.Context, args ownerArgs) (*[]*draftResolver, error) {
+	draft, state, err := fetchOwnedDraft(args)
+	if err != nil || state != "" {
+		return nil, err
+	}
+
+	cur, err := mongo.Database.Collection("draftversions").Find(mongo.Ctx, bson.M{
+		"draft_id": draft.ID,
+	}, options.Find().SetSort(bson.M{"version": 1}))
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	versions := []mongo.DraftVersion{}
+	if err = cur.All(mongo.Ctx, &versions); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	history := make([]*draftResolver, len(versions)+1)
+	for i := range versions {
+		v := versions[i].Draft
+		v.ID = draft.ID
+		v.Version = versions[i].Version
+		history[i] = &draftResolver{&v}
+	}
+	history[len(versions)] = &draftResolver{draft}
+
+	return &history, nil
+}
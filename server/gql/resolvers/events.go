@@ -0,0 +1,284 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Changes to a poll are published on events:poll:<kind>:<id>, pollEvents streams every kind while watch only follows votes, closing and releases of the quarantine.
+var pollEventKinds = []string{"vote", "closed", "reopened", "edited", "released", "deleted"}
+
+// publishPollEvent numbers a change to a poll and tells every instance about it.
+func publishPollEvent(kind string, poll *mongo.Poll, payload interface{}) error {
+	payloadStr, err := json.MarshalToString(payload)
+	if err != nil {
+		return err
+	}
+
+	closed := poll.Closed || kind == "closed"
+	seq, err := eventScript.Run(redis.Ctx, redis.Client, []string{eventSeqKey(poll.ID), eventStreamKey(poll.ID)},
+		fmt.Sprintf("events:poll:%s:%s", kind, poll.ID.Hex()), kind, payloadStr, eventRetention(), poll.EventSeq, eventExpiry(closed)).Int64()
+	if err != nil {
+		return err
+	}
+	if closed && kind != "deleted" {
+		keepEventSeq(poll.ID, seq)
+	}
+	return nil
+}
+
+type voteCastEvent struct {
+	PollID    string
+	Seq       int32
+	Selection []int32
+}
+
+type closedEvent struct {
+	PollID string
+	Seq    int32
+	At     string
+}
+
+type expiredEvent struct {
+	PollID string
+	Seq    int32
+	At     string
+}
+
+type reopenedEvent struct {
+	PollID string
+	Seq    int32
+	At     string
+	Expiry *string
+}
+
+type editedEvent struct {
+	PollID  string
+	Seq     int32
+	At      string
+	Title   string
+	Options []string
+	Expiry  *string
+}
+
+type releasedEvent struct {
+	PollID string
+	Seq    int32
+	At     string
+}
+
+type deletedEvent struct {
+	PollID string
+	Seq    int32
+	At     string
+}
+
+type pollEventResolver struct {
+	event interface{}
+}
+
+func (r *pollEventResolver) ToVoteCast() (*voteCastEvent, bool) {
+	e, ok := r.event.(*voteCastEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToClosed() (*closedEvent, bool) {
+	e, ok := r.event.(*closedEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToExpired() (*expiredEvent, bool) {
+	e, ok := r.event.(*expiredEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToReopened() (*reopenedEvent, bool) {
+	e, ok := r.event.(*reopenedEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToEdited() (*editedEvent, bool) {
+	e, ok := r.event.(*editedEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToReleased() (*releasedEvent, bool) {
+	e, ok := r.event.(*releasedEvent)
+	return e, ok
+}
+
+func (r *pollEventResolver) ToDeleted() (*deletedEvent, bool) {
+	e, ok := r.event.(*deletedEvent)
+	return e, ok
+}
+
+func formatTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.Format(time.RFC3339)
+	return &s
+}
+
+// decodePollEvent turns a message published on a poll event channel into the event it describes.
+func decodePollEvent(hex string, kind string, seq int64, payload string) (interface{}, error) {
+	switch kind {
+	case "vote":
+		vote := PollVote{}
+		if err := json.UnmarshalFromString(payload, &vote); err != nil {
+			return nil, err
+		}
+		return &voteCastEvent{hex, int32(seq), vote}, nil
+	case "closed":
+		closed := PollClosed{}
+		if err := json.UnmarshalFromString(payload, &closed); err != nil {
+			return nil, err
+		}
+		if closed.Reason == "expired" {
+			return &expiredEvent{hex, int32(seq), closed.At.Format(time.RFC3339)}, nil
+		}
+		return &closedEvent{hex, int32(seq), closed.At.Format(time.RFC3339)}, nil
+	case "reopened":
+		reopened := PollReopened{}
+		if err := json.UnmarshalFromString(payload, &reopened); err != nil {
+			return nil, err
+		}
+		return &reopenedEvent{hex, int32(seq), reopened.At.Format(time.RFC3339), formatTime(reopened.Expiry)}, nil
+	case "edited":
+		edited := PollEdited{}
+		if err := json.UnmarshalFromString(payload, &edited); err != nil {
+			return nil, err
+		}
+		return &editedEvent{hex, int32(seq), edited.At.Format(time.RFC3339), edited.Title, edited.Options, formatTime(edited.Expiry)}, nil
+	case "released":
+		released := PollReleased{}
+		if err := json.UnmarshalFromString(payload, &released); err != nil {
+			return nil, err
+		}
+		return &releasedEvent{hex, int32(seq), released.At.Format(time.RFC3339)}, nil
+	case "deleted":
+		deleted := PollDeleted{}
+		if err := json.UnmarshalFromString(payload, &deleted); err != nil {
+			return nil, err
+		}
+		return &deletedEvent{hex, int32(seq), deleted.At.Format(time.RFC3339)}, nil
+	}
+	return nil, fmt.Errorf("unknown poll event %s", kind)
+}
+
+// PollEvents streams every change to a poll as it happens, it ends once the poll is deleted.
+// With since_seq the retained events after it are replayed first, a gap in seq means older events were no longer retained.
+func (r *RootResolver) PollEvents(ctx context.Context, args struct {
+	ID       string
+	SinceSeq *int32
+}) (<-chan *pollEventResolver, error) {
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		return nil, errPollNotFound
+	}
+
+	if wait := rateLimited("watch", map[string]string{"ip": requestIP(ctx), "poll": id.Hex()}); wait > 0 {
+		return nil, rateLimitedError{wait}.queryError()
+	}
+
+	poll, err := fetchPoll(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if poll == nil {
+		return nil, errPollNotFound
+	}
+
+	// Without since_seq the stream starts from the last event before subscribing, whatever is published after it is sent.
+	var since int64
+	if args.SinceSeq = sinceSeq(ctx, args.SinceSeq); args.SinceSeq != nil {
+		since = int64(*args.SinceSeq)
+	} else {
+		seq, err := redis.Client.Get(redis.Ctx, eventSeqKey(id)).Result()
+		if err != nil && err != redis.ErrNil {
+			log.Errorf("redis, err=%v", err)
+			return nil, errInternalServer
+		}
+		since = pollSeq(poll, seq)
+	}
+
+	events := make(chan *redis.Message, 100)
+	kinds := map[string]string{}
+	for _, kind := range pollEventKinds {
+		c := fmt.Sprintf("events:poll:%s:%s", kind, id.Hex())
+		kinds[c] = kind
+		if err = r.subscribe(c, events); err != nil {
+			log.Errorf("redis, err=%v", err)
+			return nil, errInternalServer
+		}
+	}
+
+	// Subscribing first means no event falls between the replay and the live events, the events in both are sent once.
+	replay, _, err := fetchEventsSince(id, since, -1)
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	eChan := make(chan *pollEventResolver, 1)
+	go func() {
+		defer close(eChan)
+		defer func() {
+			for c := range kinds {
+				if err := r.unsubscribe(c, events); err != nil {
+					log.Errorf("redis, err=%v", err)
+				}
+			}
+		}()
+
+		cursor := newEventCursor(id, since)
+		// send sends an event along with any it skipped over, it returns false once the stream is over.
+		send := func(e storedEvent) bool {
+			for _, e := range cursor.next(e) {
+				event, err := decodePollEvent(id.Hex(), e.Kind, e.Seq, e.Payload)
+				if err != nil {
+					log.Errorf("json, err=%v", err)
+					continue
+				}
+				select {
+				case eChan <- &pollEventResolver{event}:
+				case <-ctx.Done():
+					return false
+				}
+				if _, deleted := event.(*deletedEvent); deleted {
+					return false
+				}
+			}
+			return true
+		}
+
+		for _, e := range replay {
+			if !send(e) {
+				return
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-events:
+				event, err := parseEventMessage(kinds[msg.Channel], msg.Payload)
+				if err != nil {
+					log.Errorf("json, err=%v", err)
+					continue
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}
+	}()
+
+	return eChan, nil
+}
@@ -0,0 +1,174 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Idempotency keys let clients retry a mutation without it taking effect twice, the first result under a key is stored
+// and returned to every retry until the key expires. Keys for creating polls and drafts are scoped to the client ip,
+// vote keys to the poll and the voter, its voter token if it has one so a voter that changed networks between retries is still counted once.
+const idempotencyPending = "pending"
+
+// idempotentResult is the stored result of a new or newDraft mutation.
+// The admin token is stored sealed, see sealAdminToken, so a client whose first response was lost still gets it on a retry.
+type idempotentResult struct {
+	State      string              `json:"state"`
+	ID         *primitive.ObjectID `json:"id,omitempty"`
+	AdminToken string              `json:"admin_token,omitempty"`
+}
+
+func idempotencyTTL() time.Duration {
+	if s := configure.Config.GetInt("idempotency_ttl"); s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// idempotencyKey builds the redis key holding the result of a mutation, the client key is hashed to bound its length.
+func idempotencyKey(ctx context.Context, mutation string, key string) string {
+	return fmt.Sprintf("idempotency:%s:%s", mutation, hashToken(requestIP(ctx)+"\n"+key))
+}
+
+// voteIdempotencyKey builds the redis key holding the result of a vote, scoped to the voter token, or the client ip without one,
+// so a key reused by another voter neither replays nor blocks their vote.
+func voteIdempotencyKey(id primitive.ObjectID, v voter, key string) string {
+	scope := "ip:" + v.IP
+	if v.TokenID != "" {
+		scope = "token:" + v.TokenID
+	}
+	return fmt.Sprintf("idempotency:vote:%s:%s", id.Hex(), hashToken(scope+"\n"+key))
+}
+
+// adminTokenSeal returns the key admin tokens are sealed with under an idempotency key. It is derived from the client ip and key
+// like the redis key, but hashed apart from it, so only a retry of the same request can open the token and the stored results alone give nothing away.
+func adminTokenSeal(ctx context.Context, key string) (cipher.AEAD, error) {
+	h := sha256.Sum256(utils.S2B("admin_token\n" + requestIP(ctx) + "\n" + key))
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAdminToken encrypts the admin token of a result stored under an idempotency key.
+func sealAdminToken(ctx context.Context, key string, token string) (string, error) {
+	aead, err := adminTokenSeal(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, utils.S2B(token), nil)), nil
+}
+
+// openAdminToken decrypts the admin token of a replayed result.
+func openAdminToken(ctx context.Context, key string, sealed string) (string, error) {
+	aead, err := adminTokenSeal(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed admin token too short")
+	}
+	token, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// replayAdminToken opens the admin token of a replayed result, nil if it has none or it cannot be opened.
+func replayAdminToken(ctx context.Context, key string, prev *idempotentResult) *string {
+	if prev.AdminToken == "" {
+		return nil
+	}
+	token, err := openAdminToken(ctx, key, prev.AdminToken)
+	if err != nil {
+		log.Errorf("idempotency, err=%v", err)
+		return nil
+	}
+	return &token
+}
+
+// storedAdminToken seals the admin token of a result about to be stored, empty if it has none or it cannot be sealed.
+func storedAdminToken(ctx context.Context, key string, token *string) string {
+	if token == nil {
+		return ""
+	}
+	sealed, err := sealAdminToken(ctx, key, *token)
+	if err != nil {
+		log.Errorf("idempotency, err=%v", err)
+		return ""
+	}
+	return sealed
+}
+
+// claimIdempotencyKey reserves a key for a mutation about to run, returning the stored result if the key was already used.
+// A retry that arrives while the first request is still running gets the IN_PROGRESS state.
+func claimIdempotencyKey(key string) (*idempotentResult, error) {
+	ok, err := redis.Client.SetNX(redis.Ctx, key, idempotencyPending, idempotencyTTL()).Result()
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return nil, errInternalServer
+	}
+	if ok {
+		return nil, nil
+	}
+
+	val, err := redis.Client.Get(redis.Ctx, key).Result()
+	if err == redis.ErrNil {
+		// The key expired between the two calls, so there is nothing to replay.
+		return claimIdempotencyKey(key)
+	}
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return nil, errInternalServer
+	}
+	if val == idempotencyPending {
+		return &idempotentResult{State: "IN_PROGRESS"}, nil
+	}
+
+	res := &idempotentResult{}
+	if err = json.UnmarshalFromString(val, res); err != nil {
+		log.Errorf("json, err=%v", err)
+		return nil, errInternalServer
+	}
+	return res, nil
+}
+
+// storeIdempotentResult replaces the reservation of a key with the result of the mutation.
+func storeIdempotentResult(key string, res idempotentResult) {
+	val, err := json.MarshalToString(res)
+	if err == nil {
+		err = redis.Client.Set(redis.Ctx, key, val, idempotencyTTL()).Err()
+	}
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+// releaseIdempotencyKey drops the reservation of a key after the mutation failed, so a retry runs it again.
+func releaseIdempotencyKey(key string) {
+	if err := redis.Client.Del(redis.Ctx, key).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
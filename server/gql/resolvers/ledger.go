@@ -0,0 +1,493 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The ballot log of a poll chains every ballot to the one before it, so no ballot can be changed or removed without
+// changing every later hash. The lifecycle leader writes ballots from the outbox in batches per poll, giving each the next seq of its poll in outbox order.
+//
+//	digest = sha256("<poll id>\n<ballot id>\n<selection joined by commas>"), with "\nquarantined" appended for a quarantined ballot
+//	leaf   = sha256(prev leaf || digest), the prev leaf of the first ballot is 32 zero bytes
+//
+// When the owner releases the quarantine of a poll a release entry is written to the log, with digest = sha256("<poll id>\n<entry id>\nrelease"),
+// and every quarantined ballot before it counts in the public tally.
+//
+// The chain head is the leaf of the last ballot. The digests in seq order are also the leaves of a Merkle tree, where each node is
+// sha256(left || right) and an odd node at the end of a level moves up unchanged, so a voter can prove their ballot is in the log
+// with only the Merkle root and a proof instead of the full log.
+const (
+	ballotLogLimit    = 1000
+	ballotLogMaxLimit = 10000
+
+	// ledgerHeadIdle is how long the chain head of a poll stays cached after its last ballot was written.
+	ledgerHeadIdle = 10 * time.Minute
+
+	ballotKindRelease = "release"
+)
+
+var zeroLeaf = strings.Repeat("0", sha256.Size*2)
+
+type ballotReceipt struct {
+	PollID   string
+	BallotID string
+	Digest   string
+}
+
+// parseVoteResult splits the result of the vote script into the result state and, on success, the ballot receipt.
+func parseVoteResult(id primitive.ObjectID, res string) (string, *ballotReceipt) {
+	fields := strings.Fields(res)
+	if len(fields) == 0 {
+		return res, nil
+	}
+	if len(fields) != 3 {
+		return fields[0], nil
+	}
+	return fields[0], &ballotReceipt{id.Hex(), fields[1], fields[2]}
+}
+
+func ballotDigest(ballot mongo.PollAnswer) string {
+	selection := make([]string, len(ballot.Answer))
+	for i, s := range ballot.Answer {
+		selection[i] = fmt.Sprint(s)
+	}
+	data := fmt.Sprintf("%s\n%s\n%s", ballot.PollID.Hex(), ballot.ID.Hex(), strings.Join(selection, ","))
+	if len(ballot.Flags) > 0 {
+		data += "\nquarantined"
+	}
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func releaseDigest(entry mongo.PollAnswer) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", entry.PollID.Hex(), entry.ID.Hex(), ballotKindRelease)))
+	return hex.EncodeToString(h[:])
+}
+
+func hashPair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func chainLeaf(prev, digest string) (string, error) {
+	p, err := hex.DecodeString(prev)
+	if err != nil {
+		return "", err
+	}
+	d, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hashPair(p, d)), nil
+}
+
+type ledgerHead struct {
+	Seq  int32
+	Leaf string
+	At   time.Time
+}
+
+// ledgerHeads caches the chain head of the polls the lifecycle leader recently wrote ballots for. Only the leader writes ballots,
+// a head is dropped when its poll is finalized or deleted and when no ballot was written for it in ledgerHeadIdle.
+var (
+	ledgerHeads   = map[primitive.ObjectID]ledgerHead{}
+	ledgerHeadsMu sync.Mutex
+)
+
+// resetLedger drops the cached chain heads, another instance may have extended the chains while this one was not the leader.
+func resetLedger() {
+	ledgerHeadsMu.Lock()
+	defer ledgerHeadsMu.Unlock()
+	ledgerHeads = map[primitive.ObjectID]ledgerHead{}
+}
+
+func evictLedgerHead(id primitive.ObjectID) {
+	ledgerHeadsMu.Lock()
+	defer ledgerHeadsMu.Unlock()
+	delete(ledgerHeads, id)
+}
+
+// evictIdleLedgerHeads drops the heads of the polls no ballot was written for in ledgerHeadIdle.
+func evictIdleLedgerHeads(now time.Time) {
+	ledgerHeadsMu.Lock()
+	defer ledgerHeadsMu.Unlock()
+	for id, head := range ledgerHeads {
+		if now.Sub(head.At) >= ledgerHeadIdle {
+			delete(ledgerHeads, id)
+		}
+	}
+}
+
+func fetchLedgerHead(id primitive.ObjectID) (ledgerHead, error) {
+	ledgerHeadsMu.Lock()
+	head, ok := ledgerHeads[id]
+	ledgerHeadsMu.Unlock()
+	if ok {
+		return head, nil
+	}
+	return readLedgerHead(id)
+}
+
+// readLedgerHead reads the chain head of a poll from mongo, seq is -1 while the log is empty.
+func readLedgerHead(id primitive.ObjectID) (ledgerHead, error) {
+	res := mongo.Database.Collection("pollanswers").FindOne(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"seq":     bson.M{"$exists": true},
+	}, options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"seq": 1, "leaf": 1}))
+	last := mongo.PollAnswer{}
+	err := res.Err()
+	if err == mongo.ErrNoDocuments {
+		return ledgerHead{-1, zeroLeaf, time.Time{}}, nil
+	}
+	if err == nil {
+		err = res.Decode(&last)
+	}
+	if err != nil {
+		return ledgerHead{}, err
+	}
+	return ledgerHead{*last.Seq, last.Leaf, time.Time{}}, nil
+}
+
+// appendToLedger writes ballots of a poll from the outbox into mongo as the next entries of its ballot log, in the order given.
+// It reports which ballots are in the log afterwards, always a prefix of the ballots not yet written.
+// A ballot that was already written, before a crash kept it in the outbox, is left as it is.
+func appendToLedger(id primitive.ObjectID, ballots []*mongo.PollAnswer) ([]bool, error) {
+	done := make([]bool, len(ballots))
+
+	ids := make([]primitive.ObjectID, len(ballots))
+	for i, b := range ballots {
+		ids[i] = b.ID
+	}
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+		"_id": bson.M{"$in": ids},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return done, err
+	}
+	written := []mongo.PollAnswer{}
+	if err = cur.All(mongo.Ctx, &written); err != nil {
+		return done, err
+	}
+	seen := map[primitive.ObjectID]bool{}
+	for _, w := range written {
+		seen[w.ID] = true
+	}
+
+	head, err := fetchLedgerHead(id)
+	if err != nil {
+		return done, err
+	}
+
+	pending := []int{}
+	docs := []interface{}{}
+	for i, ballot := range ballots {
+		if seen[ballot.ID] {
+			done[i] = true
+			continue
+		}
+		if ballot.Digest == "" {
+			ballot.Digest = ballotDigest(*ballot)
+		}
+		seq := head.Seq + 1
+		ballot.Seq = &seq
+		ballot.Prev = head.Leaf
+		if ballot.Leaf, err = chainLeaf(ballot.Prev, ballot.Digest); err != nil {
+			return done, err
+		}
+		head = ledgerHead{seq, ballot.Leaf, time.Now()}
+		pending = append(pending, i)
+		docs = append(docs, ballot)
+	}
+	if len(docs) == 0 {
+		return done, nil
+	}
+
+	// An unordered insert writes the whole batch even if some of it fails, the chain is then cut back to before the first failure.
+	_, err = mongo.Database.Collection("pollanswers").InsertMany(mongo.Ctx, docs, options.InsertMany().SetOrdered(false))
+	failed := len(docs)
+	if err != nil {
+		bulk, ok := err.(mongo.BulkWriteException)
+		if !ok || len(bulk.WriteErrors) == 0 {
+			// Nothing says what was written, the next run finds out what is already in the log.
+			evictLedgerHead(id)
+			return done, err
+		}
+		for _, e := range bulk.WriteErrors {
+			if e.Index < failed {
+				failed = e.Index
+			}
+		}
+
+		// Readers may have built Merkle nodes over the entries being cut while they were in the log.
+		after := []primitive.ObjectID{}
+		for _, i := range pending[failed+1:] {
+			after = append(after, ballots[i].ID)
+		}
+		if len(after) > 0 {
+			if _, derr := mongo.Database.Collection("pollanswers").DeleteMany(mongo.Ctx, bson.M{
+				"_id": bson.M{"$in": after},
+			}); derr != nil {
+				log.Errorf("mongo, err=%v", derr)
+			}
+			if derr := truncateMerkle(id, *ballots[pending[failed+1]].Seq); derr != nil {
+				log.Errorf("mongo, err=%v", derr)
+			}
+		}
+
+		// The cached head is behind if another instance wrote to the log, it is read again next time.
+		evictLedgerHead(id)
+		if mongo.IsDuplicateKeyError(err) {
+			err = fmt.Errorf("ballot log of poll=%s moved on", id.Hex())
+		}
+	}
+
+	for _, i := range pending[:failed] {
+		done[i] = true
+		extendMerkle(id, *ballots[i].Seq)
+	}
+	if err == nil {
+		ledgerHeadsMu.Lock()
+		ledgerHeads[id] = head
+		ledgerHeadsMu.Unlock()
+	}
+	return done, err
+}
+
+type merkleStep struct {
+	Hash string
+	// Left is true when the sibling hash goes on the left of the running hash.
+	Left bool
+}
+
+// merkleTree returns the Merkle root over the leaves.
+func merkleTree(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, hashPair(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+type ballotInclusion struct {
+	Seq        int32
+	Digest     string
+	Prev       string
+	Leaf       string
+	Head       string
+	HeadSeq    int32
+	MerkleRoot string
+	Proof      []merkleStep
+}
+
+// BallotInclusion proves a ballot is in the ballot log of its poll, null until the ballot is written to the log.
+func (*RootResolver) BallotInclusion(ctx context.Context, args struct {
+	PollID   string
+	BallotID string
+}) (*ballotInclusion, error) {
+	if wait := rateLimited("ballot_log", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return nil, rateLimitedError{wait}
+	}
+
+	pollID, err := primitive.ObjectIDFromHex(args.PollID)
+	if err != nil {
+		return nil, nil
+	}
+	ballotID, err := primitive.ObjectIDFromHex(args.BallotID)
+	if err != nil {
+		return nil, nil
+	}
+
+	res := mongo.Database.Collection("pollanswers").FindOne(mongo.Ctx, bson.M{
+		"_id":     ballotID,
+		"poll_id": pollID,
+	})
+	ballot := mongo.PollAnswer{}
+	err = res.Err()
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err == nil {
+		err = res.Decode(&ballot)
+	}
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+	if ballot.Seq == nil {
+		return nil, nil
+	}
+
+	// The log can only have grown since the ballot was read, so its seq is still in range.
+	head, err := readLedgerHead(pollID)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+	tree := newMerkleNodes(pollID)
+	root, err := tree.root(head.Seq + 1)
+	if err != nil {
+		log.Errorf("ledger, poll=%s err=%v", pollID.Hex(), err)
+		return nil, errInternalServer
+	}
+	proof, err := tree.proof(*ballot.Seq, head.Seq+1)
+	if err != nil {
+		log.Errorf("ledger, poll=%s err=%v", pollID.Hex(), err)
+		return nil, errInternalServer
+	}
+
+	return &ballotInclusion{
+		Seq:        *ballot.Seq,
+		Digest:     ballot.Digest,
+		Prev:       ballot.Prev,
+		Leaf:       ballot.Leaf,
+		Head:       head.Leaf,
+		HeadSeq:    head.Seq,
+		MerkleRoot: hex.EncodeToString(root),
+		Proof:      proof,
+	}, nil
+}
+
+type ballotLog struct {
+	PollID     string
+	Ballots    int32
+	Unlogged   int32
+	Head       *string
+	MerkleRoot *string
+	Entries    []ballotLogEntry
+}
+
+type ballotLogEntry struct {
+	Seq         int32
+	BallotID    string
+	Release     bool
+	Selection   []int32
+	Quarantined bool
+	Digest      string
+	Prev        string
+	Leaf        string
+}
+
+// BallotLog exports the ballot log of a poll, so anyone can check the chain and recompute the tally.
+// Entries are paged by seq, voter ips and tokens are never exported.
+func (*RootResolver) BallotLog(ctx context.Context, args struct {
+	ID       string
+	AfterSeq *int32
+	Limit    *int32
+}) (*ballotLog, error) {
+	if wait := rateLimited("ballot_log", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return nil, rateLimitedError{wait}
+	}
+
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		return nil, nil
+	}
+
+	poll, err := fetchPoll(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if poll == nil {
+		return nil, nil
+	}
+
+	head, err := readLedgerHead(id)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	unlogged, err := mongo.Database.Collection("pollanswers").CountDocuments(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"seq":     bson.M{"$exists": false},
+	})
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	res := &ballotLog{
+		PollID:   id.Hex(),
+		Ballots:  head.Seq + 1,
+		Unlogged: int32(unlogged),
+		Entries:  []ballotLogEntry{},
+	}
+	if head.Seq == -1 {
+		return res, nil
+	}
+	root, err := newMerkleNodes(id).root(head.Seq + 1)
+	if err != nil {
+		log.Errorf("ledger, poll=%s err=%v", id.Hex(), err)
+		return nil, errInternalServer
+	}
+	rootStr := hex.EncodeToString(root)
+	res.MerkleRoot = &rootStr
+	res.Head = &head.Leaf
+
+	after := int32(-1)
+	if args.AfterSeq != nil {
+		after = *args.AfterSeq
+	}
+	limit := int64(ballotLogLimit)
+	if args.Limit != nil && *args.Limit > 0 {
+		limit = int64(*args.Limit)
+		if limit > ballotLogMaxLimit {
+			limit = ballotLogMaxLimit
+		}
+	}
+
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"seq":     bson.M{"$gt": after, "$lte": head.Seq},
+	}, options.Find().SetSort(bson.M{"seq": 1}).SetLimit(limit).SetProjection(bson.M{"ip": 0, "voter": 0}))
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+	entries := []mongo.PollAnswer{}
+	if err = cur.All(mongo.Ctx, &entries); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	for _, e := range entries {
+		res.Entries = append(res.Entries, ballotLogEntry{
+			Seq:         *e.Seq,
+			BallotID:    e.ID.Hex(),
+			Release:     e.Kind == ballotKindRelease,
+			Selection:   e.Answer,
+			Quarantined: len(e.Flags) > 0,
+			Digest:      e.Digest,
+			Prev:        e.Prev,
+			Leaf:        e.Leaf,
+		})
+	}
+
+	return res, nil
+}
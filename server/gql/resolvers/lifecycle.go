@@ -0,0 +1,252 @@
+package resolvers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The lifecycle worker writes queued ballots into mongo, finalizes polls when they expire, and periodically snapshots and reconciles vote tallies.
+// Jobs are members of a redis sorted set scored by the unix time in milliseconds they are due, so they survive restarts,
+// and only the instance holding the lifecycle lock runs them.
+const (
+	lifecycleJobs     = "jobs:lifecycle"
+	lifecycleLock     = "locks:lifecycle"
+	lifecycleLockTTL  = 15 * time.Second
+	lifecycleInterval = time.Second
+	lifecycleBatch    = 100
+)
+
+// renewLock extends a lock only if this instance still holds it.
+var renewLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// completeJob removes a job only if it was not rescheduled while it ran.
+var completeJob = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func expireJob(id primitive.ObjectID) string {
+	return fmt.Sprintf("expire:%s", id.Hex())
+}
+
+// scheduleExpiry queues the poll to be finalized at its expiry, or drops the queued job if it no longer expires.
+func scheduleExpiry(poll *mongo.Poll) {
+	var err error
+	if poll.Expiry == nil {
+		err = redis.Client.ZRem(redis.Ctx, lifecycleJobs, expireJob(poll.ID)).Err()
+	} else {
+		err = redis.Client.ZAdd(redis.Ctx, lifecycleJobs, &redis.Z{
+			Score:  float64(poll.Expiry.UnixNano() / int64(time.Millisecond)),
+			Member: expireJob(poll.ID),
+		}).Err()
+	}
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+func runLifecycle() {
+	node, err := utils.GenerateRandomString(16)
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return
+	}
+
+	leader := false
+	tick := time.NewTicker(lifecycleInterval)
+	defer tick.Stop()
+
+	var lastSnapshot, lastReconcile time.Time
+
+	for now := range tick.C {
+		if leader {
+			n, err := renewLock.Run(redis.Ctx, redis.Client, []string{lifecycleLock}, node, lifecycleLockTTL.Milliseconds()).Int()
+			leader = err == nil && n == 1
+			if err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+		} else {
+			leader, err = redis.Client.SetNX(redis.Ctx, lifecycleLock, node, lifecycleLockTTL).Result()
+			if err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+			if leader {
+				log.Infof("lifecycle, acquired lock node=%s", node)
+				resetLedger()
+				recoverOutbox()
+				backfillExpiries()
+			}
+		}
+
+		if leader {
+			drainOutbox()
+			runDueJobs()
+
+			if now.Sub(lastSnapshot) >= snapshotInterval() {
+				lastSnapshot = now
+				snapshotDirtyPolls()
+			}
+			if now.Sub(lastReconcile) >= reconcileInterval() {
+				lastReconcile = now
+				reconcileSnapshottedPolls()
+			}
+		}
+	}
+}
+
+// backfillExpiries queues every unfinalized poll with an expiry, including polls created before the lifecycle worker existed.
+func backfillExpiries() {
+	cur, err := mongo.Database.Collection("polls").Find(mongo.Ctx, bson.M{
+		"expiry": bson.M{"$ne": nil},
+		"closed": bson.M{"$ne": true},
+	})
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return
+	}
+
+	polls := []*mongo.Poll{}
+	if err = cur.All(mongo.Ctx, &polls); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return
+	}
+
+	pipe := redis.Client.Pipeline()
+	for _, p := range polls {
+		pipe.ZAddNX(redis.Ctx, lifecycleJobs, &redis.Z{
+			Score:  float64(p.Expiry.UnixNano() / int64(time.Millisecond)),
+			Member: expireJob(p.ID),
+		})
+	}
+	if _, err = pipe.Exec(redis.Ctx); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+func runDueJobs() {
+	jobs, err := redis.Client.ZRangeByScoreWithScores(redis.Ctx, lifecycleJobs, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond)),
+		Count: lifecycleBatch,
+	}).Result()
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		member := job.Member.(string)
+		if err = runJob(member); err != nil {
+			log.Errorf("lifecycle, job=%s err=%v", member, err)
+			continue
+		}
+		if err = completeJob.Run(redis.Ctx, redis.Client, []string{lifecycleJobs}, member, strconv.FormatFloat(job.Score, 'f', -1, 64)).Err(); err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+	}
+}
+
+func runJob(member string) error {
+	kind, hex := member, ""
+	if i := strings.IndexByte(member, ':'); i != -1 {
+		kind, hex = member[:i], member[i+1:]
+	}
+
+	switch kind {
+	case "expire":
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			return nil
+		}
+		return expirePoll(id)
+	}
+
+	log.Warnf("lifecycle, unknown job=%s", member)
+	return nil
+}
+
+// expirePoll finalizes a poll that reached its expiry, jobs for deleted, extended or already finalized polls are dropped.
+func expirePoll(id primitive.ObjectID) error {
+	res := mongo.Database.Collection("polls").FindOne(mongo.Ctx, bson.M{
+		"_id": id,
+	})
+	poll := &mongo.Poll{}
+	err := res.Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err == nil {
+		err = res.Decode(poll)
+	}
+	if err != nil {
+		return err
+	}
+
+	if poll.Expiry == nil || poll.Expiry.After(time.Now()) || poll.Closed {
+		return nil
+	}
+
+	return finalizePoll(poll, "expired", *poll.Expiry)
+}
+
+// A poll is marked closed in redis before its tally is snapshotted, the vote script refuses ballots for a marked poll
+// so a vote that read the poll before it closed cannot land after the snapshot. The marker outlives any cached copy of the open poll.
+const closedMarkerTTL = time.Hour * 6
+
+func closedMarkerKey(id primitive.ObjectID) string {
+	return fmt.Sprintf("poll:closed:%s", id.Hex())
+}
+
+// finalizePoll snapshots the tally of a poll into mongo, marks it closed and tells watchers it closed.
+func finalizePoll(poll *mongo.Poll, reason string, at time.Time) error {
+	if err := redis.Client.Set(redis.Ctx, closedMarkerKey(poll.ID), at.UnixNano()/int64(time.Millisecond), closedMarkerTTL).Err(); err != nil {
+		return err
+	}
+
+	votes, scores, err := fetchTally(poll.ID)
+	if err != nil {
+		return err
+	}
+
+	results, err := buildOptions(poll, votes, scores)
+	if err != nil {
+		return err
+	}
+
+	if _, err = mongo.Database.Collection("polls").UpdateOne(mongo.Ctx, bson.M{
+		"_id": poll.ID,
+	}, bson.M{
+		"$set": bson.M{
+			"closed":     true,
+			"closed_at":  at,
+			"results":    results,
+			"results_at": time.Now(),
+		},
+	}); err != nil {
+		return err
+	}
+
+	invalidatePoll(poll.ID)
+	evictLedgerHead(poll.ID)
+
+	return publishPollEvent("closed", poll, PollClosed{
+		Reason: reason,
+		At:     at,
+	})
+}
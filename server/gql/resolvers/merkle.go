@@ -0,0 +1,251 @@
+package resolvers
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The node at level l and index i of the Merkle tree over a ballot log covers the digests i*2^l up to (i+1)*2^l, the digests themselves
+// are level 0. Once a node covers all of its digests it never changes, so complete nodes are kept in the ballottree collection as the log grows
+// and a root or proof only reads the nodes on its path instead of the whole log. Only the nodes on the right edge of the tree are partial,
+// those are combined from the complete nodes below them on every read.
+//
+// merkleBulkLevel is the highest level of a missing node that is computed straight from its digests, higher nodes are built from their children.
+const merkleBulkLevel = 10
+
+type merkleKey struct {
+	level int32
+	index int32
+}
+
+// merkleNodes reads the nodes of the Merkle tree over the ballot log of a poll, computing and storing any complete node that is missing.
+type merkleNodes struct {
+	id    primitive.ObjectID
+	nodes map[merkleKey][]byte
+}
+
+func newMerkleNodes(id primitive.ObjectID) *merkleNodes {
+	return &merkleNodes{id, map[merkleKey][]byte{}}
+}
+
+// stored reads the given complete nodes of one level, nodes that are not stored yet are left out.
+func (m *merkleNodes) stored(level int32, indexes ...int32) (map[int32][]byte, error) {
+	found := map[int32][]byte{}
+	missing := []int32{}
+	for _, i := range indexes {
+		if h, ok := m.nodes[merkleKey{level, i}]; ok {
+			found[i] = h
+		} else {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	if level == 0 {
+		cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+			"poll_id": m.id,
+			"seq":     bson.M{"$in": missing},
+		}, options.Find().SetProjection(bson.M{"seq": 1, "digest": 1}))
+		if err != nil {
+			return nil, err
+		}
+		entries := []mongo.PollAnswer{}
+		if err = cur.All(mongo.Ctx, &entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			h, err := hex.DecodeString(e.Digest)
+			if err != nil {
+				return nil, err
+			}
+			found[*e.Seq] = h
+			m.nodes[merkleKey{0, *e.Seq}] = h
+		}
+		return found, nil
+	}
+
+	cur, err := mongo.Database.Collection("ballottree").Find(mongo.Ctx, bson.M{
+		"poll_id": m.id,
+		"level":   level,
+		"index":   bson.M{"$in": missing},
+	})
+	if err != nil {
+		return nil, err
+	}
+	nodes := []mongo.MerkleNode{}
+	if err = cur.All(mongo.Ctx, &nodes); err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		h, err := hex.DecodeString(n.Hash)
+		if err != nil {
+			return nil, err
+		}
+		found[n.Index] = h
+		m.nodes[merkleKey{level, n.Index}] = h
+	}
+	return found, nil
+}
+
+// node returns a complete node, the caller makes sure every digest it covers is in the log.
+func (m *merkleNodes) node(level int32, index int32) ([]byte, error) {
+	found, err := m.stored(level, index)
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := found[index]; ok {
+		return h, nil
+	}
+	if level == 0 {
+		return nil, fmt.Errorf("ballot log of poll=%s has no seq=%d", m.id.Hex(), index)
+	}
+
+	var h []byte
+	children, err := m.stored(level-1, 2*index, 2*index+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(children) == 2 {
+		h = hashPair(children[2*index], children[2*index+1])
+	} else if level <= merkleBulkLevel {
+		if h, err = m.fromDigests(level, index); err != nil {
+			return nil, err
+		}
+	} else {
+		left, err := m.node(level-1, 2*index)
+		if err != nil {
+			return nil, err
+		}
+		right, err := m.node(level-1, 2*index+1)
+		if err != nil {
+			return nil, err
+		}
+		h = hashPair(left, right)
+	}
+
+	m.nodes[merkleKey{level, index}] = h
+	if _, err = mongo.Database.Collection("ballottree").UpdateOne(mongo.Ctx, bson.M{
+		"poll_id": m.id,
+		"level":   level,
+		"index":   index,
+	}, bson.M{
+		"$setOnInsert": bson.M{
+			"last": (index+1)<<level - 1,
+			"hash": hex.EncodeToString(h),
+		},
+	}, options.Update().SetUpsert(true)); err != nil && !mongo.IsDuplicateKeyError(err) {
+		// The node is computed again by the next read, it is not worth failing this one.
+		log.Errorf("mongo, err=%v", err)
+	}
+	return h, nil
+}
+
+// fromDigests computes a complete node from the digests it covers in one read.
+func (m *merkleNodes) fromDigests(level int32, index int32) ([]byte, error) {
+	size := int32(1) << level
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+		"poll_id": m.id,
+		"seq":     bson.M{"$gte": index * size, "$lt": (index + 1) * size},
+	}, options.Find().SetSort(bson.M{"seq": 1}).SetProjection(bson.M{"digest": 1}))
+	if err != nil {
+		return nil, err
+	}
+	entries := []mongo.PollAnswer{}
+	if err = cur.All(mongo.Ctx, &entries); err != nil {
+		return nil, err
+	}
+	if int32(len(entries)) != size {
+		return nil, fmt.Errorf("ballot log of poll=%s is missing digests of level=%d index=%d", m.id.Hex(), level, index)
+	}
+
+	digests := make([][]byte, len(entries))
+	for i, e := range entries {
+		if digests[i], err = hex.DecodeString(e.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return merkleTree(digests), nil
+}
+
+// at returns the node at level and index of the tree over the first n digests, which is partial on the right edge.
+// It returns nil if the node covers none of the n digests.
+func (m *merkleNodes) at(level int32, index int32, n int32) ([]byte, error) {
+	start := int64(index) << level
+	end := int64(index+1) << level
+	if start >= int64(n) {
+		return nil, nil
+	}
+	if end <= int64(n) {
+		return m.node(level, index)
+	}
+
+	// An odd node at the end of a level moves up unchanged.
+	left, err := m.at(level-1, 2*index, n)
+	if err != nil {
+		return nil, err
+	}
+	right, err := m.at(level-1, 2*index+1, n)
+	if err != nil || right == nil {
+		return left, err
+	}
+	return hashPair(left, right), nil
+}
+
+// merkleHeight returns the level of the root of the tree over n digests.
+func merkleHeight(n int32) int32 {
+	var h int32
+	for int64(1)<<h < int64(n) {
+		h++
+	}
+	return h
+}
+
+// root returns the Merkle root over the first n digests of the log.
+func (m *merkleNodes) root(n int32) ([]byte, error) {
+	return m.at(merkleHeight(n), 0, n)
+}
+
+// proof returns the proof of the digest at seq in the tree over the first n digests of the log.
+func (m *merkleNodes) proof(seq int32, n int32) ([]merkleStep, error) {
+	proof := []merkleStep{}
+	index := seq
+	for level := int32(0); level < merkleHeight(n); level++ {
+		sibling, err := m.at(level, index^1, n)
+		if err != nil {
+			return nil, err
+		}
+		if sibling != nil {
+			proof = append(proof, merkleStep{hex.EncodeToString(sibling), index%2 == 1})
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// extendMerkle stores every node completed by the digest at seq, the lifecycle leader calls it as it writes the log.
+func extendMerkle(id primitive.ObjectID, seq int32) {
+	m := newMerkleNodes(id)
+	for level, index := int32(1), seq; index%2 == 1; level, index = level+1, index/2 {
+		if _, err := m.node(level, index/2); err != nil {
+			log.Errorf("ledger, poll=%s err=%v", id.Hex(), err)
+			return
+		}
+	}
+}
+
+// truncateMerkle drops the stored nodes covering the digest at seq or any later one, for when the log is cut back to before seq.
+func truncateMerkle(id primitive.ObjectID, seq int32) error {
+	_, err := mongo.Database.Collection("ballottree").DeleteMany(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"last":    bson.M{"$gte": seq},
+	})
+	return err
+}
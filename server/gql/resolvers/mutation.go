@@ -6,209 +6,434 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/challenge"
 	"github.com/troydota/api.poll.komodohype.dev/mongo"
 	"github.com/troydota/api.poll.komodohype.dev/redis"
-	"github.com/troydota/api.poll.komodohype.dev/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type newInput struct {
-	Title       string
-	Options     []string
-	CheckIP     *bool
-	MultiAnswer *bool
-	Expiry      *int32
+	Title            string
+	Type             *string
+	Options          []string
+	CheckIP          *bool
+	DedupMode        *string
+	RequireChallenge *bool
+	MultiAnswer      *bool
+	MinSelections    *int32
+	MaxSelections    *int32
+	ScoreMin         *int32
+	ScoreMax         *int32
+	OpensAt          *int32
+	Expiry           *int32
 }
 
-func (*RootResolver) Vote(ctx context.Context, args struct {
-	ID        string
-	Selection []int32
-}) (string, error) {
-	id, err := primitive.ObjectIDFromHex(args.ID)
-	if err != nil {
-		return "", errMissingPoll
+// validateNewInput checks a poll or draft input, returning the failing result state or an empty string if it is valid.
+func validateNewInput(in newInput) string {
+	if len(in.Title) > 64 || len(in.Title) == 0 {
+		return "INVALID_TITLE"
 	}
 
-	poll, err := fetchPoll(id, nil)
+	if len(in.Options) < 2 || len(in.Options) > 15 {
+		return "INVALID_OPTIONS"
+	}
+	for _, o := range in.Options {
+		if len(o) > 64 || len(o) == 0 {
+			return "INVALID_OPTIONS"
+		}
+	}
+
+	min, max := inputSelectionBounds(in)
+	if min < 1 || min > max || max > int32(len(in.Options)) {
+		return "INVALID_SELECTION_LIMITS"
+	}
+
+	if in.Type != nil && *in.Type == pollTypeScore {
+		min, max := inputScoreRange(in)
+		if min < 0 || min >= max || max > 100 {
+			return "INVALID_SCORE_RANGE"
+		}
+	}
+
+	if in.OpensAt != nil && *in.OpensAt < 0 {
+		return "INVALID_OPENS_AT"
+	}
+
+	if in.RequireChallenge != nil && *in.RequireChallenge && challenge.Default == nil {
+		return "CHALLENGE_UNAVAILABLE"
+	}
+
+	// Token modes cannot be used when this server does not issue voter tokens.
+	if mode := inputDedupMode(in); (mode == dedupToken || mode == dedupIPAndToken) && len(voterTokenSecret()) == 0 {
+		return "INVALID_DEDUP_MODE"
+	}
+
+	if in.Expiry != nil && *in.Expiry < 60 && *in.Expiry != 0 {
+		return "INVALID_EXPIRY"
+	}
+
+	// A scheduled poll must still be open for at least a minute.
+	if in.OpensAt != nil && in.Expiry != nil && *in.Expiry != 0 && *in.Expiry-*in.OpensAt < 60 {
+		return "INVALID_EXPIRY"
+	}
+
+	return ""
+}
+
+// inputScoreRange resolves the score scale of a poll or draft input, defaulting to 1 to 5.
+func inputScoreRange(in newInput) (int32, int32) {
+	var min, max int32 = 1, 5
+	if in.ScoreMin != nil {
+		min = *in.ScoreMin
+	}
+	if in.ScoreMax != nil {
+		max = *in.ScoreMax
+	}
+	return min, max
+}
+
+// inputSelectionBounds resolves the selection limits of a poll or draft input.
+// The maximum defaults to every option on multi answer and ranked polls, otherwise to the minimum.
+func inputSelectionBounds(in newInput) (int32, int32) {
+	if in.Type != nil && *in.Type == pollTypeScore {
+		return int32(len(in.Options)), int32(len(in.Options))
+	}
+
+	var min, max int32 = 1, 0
+	if in.MinSelections != nil {
+		min = *in.MinSelections
+	}
+	if in.MaxSelections != nil {
+		max = *in.MaxSelections
+	} else if in.MultiAnswer != nil && *in.MultiAnswer || in.Type != nil && *in.Type == pollTypeRanked {
+		max = int32(len(in.Options))
+	} else {
+		max = min
+	}
+	return min, max
+}
+
+type voteArgs struct {
+	ID             string
+	Selection      []int32
+	IdempotencyKey *string
+	ChallengeToken *string
+}
+
+func (*RootResolver) Vote(ctx context.Context, args voteArgs) (string, error) {
+	res, err := vote(ctx, args)
+	return res.State, err
+}
+
+type voteResult struct {
+	State      string
+	Receipt    *ballotReceipt
+	RetryAfter *int32
+}
+
+// VoteWithReceipt votes like Vote, returning a receipt the voter can later check for inclusion in the ballot log.
+func (*RootResolver) VoteWithReceipt(ctx context.Context, args voteArgs) (voteResult, error) {
+	return vote(ctx, args)
+}
+
+func vote(ctx context.Context, args voteArgs) (voteResult, error) {
+	id, err := primitive.ObjectIDFromHex(args.ID)
 	if err != nil {
-		return "", err
+		return voteResult{}, errMissingPoll
 	}
 
-	l := len(args.Selection)
+	v := voterFromContext(ctx)
 
-	if l == 0 || l > len(poll.OptionsRaw) || l > 1 && !poll.MultiAnswer {
-		return "INVALID_SELECTION", nil
+	// A retry returns the state of the first attempt, before the poll could have expired or closed since.
+	var idempotency string
+	if args.IdempotencyKey != nil {
+		idempotency = voteIdempotencyKey(id, v, *args.IdempotencyKey)
+		prev, err := redis.Client.Get(redis.Ctx, idempotency).Result()
+		if err != nil && err != redis.ErrNil {
+			log.Errorf("redis, err=%v", err)
+			return voteResult{}, errInternalServer
+		}
+		if prev != "" {
+			state, receipt := parseVoteResult(id, prev)
+			return voteResult{state, receipt, nil}, nil
+		}
 	}
 
-	if poll.Expiry != nil && poll.Expiry.Before(time.Now()) {
-		return "EXPIRED", nil
+	if wait := rateLimited("vote", map[string]string{"ip": requestIP(ctx), "poll": id.Hex()}); wait > 0 {
+		return voteResult{"RATE_LIMITED", nil, retryAfter(wait)}, nil
 	}
 
-	_ip := ctx.Value(utils.Key("ip"))
-	var ip string
-	if _ip != nil {
-		ip = _ip.(string)
+	poll, err := fetchPoll(id, nil)
+	if err != nil {
+		return voteResult{}, err
+	}
+	if poll == nil {
+		return voteResult{"MISSING_POLL", nil, nil}, nil
+	}
+
+	min, max := pollSelectionBounds(poll)
+	l := int32(len(args.Selection))
+
+	if l < min {
+		return voteResult{"TOO_FEW_SELECTIONS", nil, nil}, nil
+	}
+	if l > max {
+		return voteResult{"TOO_MANY_SELECTIONS", nil, nil}, nil
 	}
 
-	if poll.CheckIP {
-		if ip != "" {
-			val, err := redis.Client.SAdd(redis.Ctx, fmt.Sprintf("poll:votes:%s:ips", poll.ID.Hex()), ip).Result()
-			if err != nil && err != redis.ErrNil {
-				log.Errorf("redis, err=%v", err)
-				return "", errInternalServer
+	if pollType(poll) == pollTypeScore {
+		for _, s := range args.Selection {
+			if s < poll.ScoreMin || s > poll.ScoreMax {
+				return voteResult{"SCORE_OUT_OF_RANGE", nil, nil}, nil
+			}
+		}
+	} else {
+		seen := make([]bool, len(poll.OptionsRaw))
+		for _, s := range args.Selection {
+			if s < 0 || int(s) >= len(poll.OptionsRaw) {
+				return voteResult{"SELECTION_OUT_OF_RANGE", nil, nil}, nil
 			}
-			if val == 0 {
-				return "ALREADY_VOTED", nil
+			if seen[s] {
+				return voteResult{"DUPLICATE_SELECTION", nil, nil}, nil
 			}
-		} else {
-			return "ALREADY_VOTED", nil
+			seen[s] = true
 		}
 	}
 
-	_, err = mongo.Database.Collection("pollanswers").InsertOne(mongo.Ctx, mongo.PollAnswer{
-		PollID: poll.ID,
-		IP:     ip,
-		Answer: args.Selection,
-	})
-	if err != nil {
-		log.Errorf("mongo, err=%v", err)
+	if poll.Expiry != nil && poll.Expiry.Before(time.Now()) {
+		return voteResult{"EXPIRED", nil, nil}, nil
 	}
 
-	pipe := redis.Client.Pipeline()
+	if poll.Closed {
+		return voteResult{"CLOSED", nil, nil}, nil
+	}
 
-	selectionStr, err := json.MarshalToString(args.Selection)
-	if err != nil {
-		log.Errorf("json, err=%v", err)
-	} else {
-		event := fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex())
-		pipe.Publish(redis.Ctx, event, selectionStr)
+	if poll.OpensAt != nil && poll.OpensAt.After(time.Now()) {
+		return voteResult{"NOT_OPEN_YET", nil, nil}, nil
+	}
+
+	if state, err := checkChallenge(ctx, poll.RequireChallenge || challenge.Required(), args.ChallengeToken); err != nil || state != "" {
+		return voteResult{state, nil, nil}, err
 	}
 
-	for _, s := range args.Selection {
-		pipe.HIncrBy(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", poll.ID.Hex()), fmt.Sprint(s), 1)
+	members, state := dedupStrategies[pollDedupMode(poll)].members(v)
+	if state != "" {
+		return voteResult{state, nil, nil}, nil
 	}
 
-	_, err = pipe.Exec(redis.Ctx)
+	ballot := mongo.PollAnswer{
+		ID:     primitive.NewObjectID(),
+		PollID: poll.ID,
+		IP:     v.IP,
+		Answer: args.Selection,
+		Voter:  members,
+	}
+	flags, counters := detectAnomalies(poll, ballot)
+	ballot.Flags = flags
+	ballot.Digest = ballotDigest(ballot)
+
+	res, err := castBallot(poll, ballot, counters, idempotency)
 	if err != nil {
-		log.Errorf("vote-pipe, err=%v", err)
+		log.Errorf("redis, err=%v", err)
+		return voteResult{}, errInternalServer
 	}
 
-	return "SUCCESS", nil
+	state, receipt := parseVoteResult(poll.ID, res)
+	return voteResult{state, receipt, nil}, nil
 }
 
 type result struct {
-	State string
-	Poll  *pollResolver
+	State      string
+	Poll       *pollResolver
+	AdminToken *string
+	RetryAfter *int32
 }
 
 func (*RootResolver) New(ctx context.Context, args struct {
-	Poll newInput
+	Poll           newInput
+	IdempotencyKey *string
+	ChallengeToken *string
 }) (result, error) {
-	if len(args.Poll.Title) > 64 || len(args.Poll.Title) == 0 {
-		return result{"INVALID_TITLE", nil}, nil
+	if wait := rateLimited("new", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return result{"RATE_LIMITED", nil, nil, retryAfter(wait)}, nil
 	}
 
-	if len(args.Poll.Options) < 2 || len(args.Poll.Options) > 15 {
-		return result{"INVALID_OPTIONS", nil}, nil
+	field := generateSelectedFieldMap(ctx).children["poll"]
+	if args.IdempotencyKey == nil {
+		return newPoll(ctx, args.Poll, args.ChallengeToken, field)
 	}
-	for _, o := range args.Poll.Options {
-		if len(o) > 64 || len(o) == 0 {
-			return result{"INVALID_OPTIONS", nil}, nil
+
+	key := idempotencyKey(ctx, "new", *args.IdempotencyKey)
+	prev, err := claimIdempotencyKey(key)
+	if err != nil {
+		return result{}, err
+	}
+	if prev != nil {
+		res := result{prev.State, nil, replayAdminToken(ctx, *args.IdempotencyKey, prev), nil}
+		if prev.ID != nil {
+			poll, err := fetchPoll(*prev.ID, field)
+			if err != nil {
+				return result{}, err
+			}
+			if poll != nil {
+				res.Poll = &pollResolver{poll, field}
+			}
 		}
+		return res, nil
 	}
 
-	var expiry int32
-	if args.Poll.Expiry != nil {
-		expiry = *args.Poll.Expiry
+	res, err := newPoll(ctx, args.Poll, args.ChallengeToken, field)
+	if err != nil || challengeState(res.State) {
+		releaseIdempotencyKey(key)
+		return res, err
+	}
+	stored := idempotentResult{State: res.State, AdminToken: storedAdminToken(ctx, *args.IdempotencyKey, res.AdminToken)}
+	if res.Poll != nil {
+		stored.ID = &res.Poll.poll.ID
 	}
+	storeIdempotentResult(key, stored)
+
+	return res, nil
+}
 
-	if expiry < 60 && expiry != 0 {
-		return result{"INVALID_EXPIRY", nil}, nil
+func newPoll(ctx context.Context, in newInput, challengeToken *string, field *selectedField) (result, error) {
+	if state := validateNewInput(in); state != "" {
+		return result{state, nil, nil, nil}, nil
+	}
+
+	if state, err := checkChallenge(ctx, challenge.Required(), challengeToken); err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	var expiry int32
+	if in.Expiry != nil {
+		expiry = *in.Expiry
 	}
 
 	poll := &mongo.Poll{
-		Title:      args.Poll.Title,
-		OptionsRaw: args.Poll.Options,
+		Title:      in.Title,
+		Type:       pollTypeStandard,
+		OptionsRaw: in.Options,
+	}
+	if in.Type != nil {
+		poll.Type = *in.Type
 	}
 
+	now := time.Now()
 	if expiry > 0 {
-		exp := time.Now().Add(time.Duration(expiry) * time.Second)
+		exp := now.Add(time.Duration(expiry) * time.Second)
 		poll.Expiry = &exp
 	}
+	if in.OpensAt != nil && *in.OpensAt > 0 {
+		opens := now.Add(time.Duration(*in.OpensAt) * time.Second)
+		poll.OpensAt = &opens
+	}
+
+	poll.DedupMode = inputDedupMode(in)
+	poll.CheckIP = dedupStrategies[poll.DedupMode].usesIP()
+	poll.RequireChallenge = in.RequireChallenge != nil && *in.RequireChallenge
+	poll.MinSelections, poll.MaxSelections = inputSelectionBounds(in)
+	if poll.Type == pollTypeScore {
+		poll.ScoreMin, poll.ScoreMax = inputScoreRange(in)
+	}
 
-	if args.Poll.CheckIP != nil {
-		poll.CheckIP = *args.Poll.CheckIP
+	token, err := createPoll(poll)
+	if err != nil {
+		return result{}, err
 	}
-	if args.Poll.MultiAnswer != nil {
-		poll.MultiAnswer = *args.Poll.MultiAnswer
+
+	return result{"SUCCESS", &pollResolver{poll, field}, &token, nil}, nil
+}
+
+// createPoll inserts a new poll and caches it, returning the admin token of the poll.
+// Only a hash of the token is stored, so it cannot be recovered after this.
+func createPoll(poll *mongo.Poll) (string, error) {
+	token, hash, err := newAdminToken()
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return "", errInternalServer
 	}
+	poll.AdminTokenHash = hash
 
 	res, err := mongo.Database.Collection("polls").InsertOne(mongo.Ctx, poll)
 	if err != nil {
 		log.Errorf("mongo, err=%v", err)
-		return result{}, errInternalServer
+		return "", errInternalServer
 	}
 	poll.ID = res.InsertedID.(primitive.ObjectID)
 
-	pollStr, err := json.MarshalToString(poll)
-	if err == nil {
-		if err = redis.Client.Set(redis.Ctx, fmt.Sprintf("cached:polls:%s", poll.ID.Hex()), pollStr, time.Hour*6).Err(); err != nil {
-			log.Errorf("redis, err=%v", err)
-		}
-	} else {
-		log.Errorf("redis, err=%v", err)
-	}
+	cachePoll(poll)
+	scheduleExpiry(poll)
 
-	field := generateSelectedFieldMap(ctx)
-
-	return result{"SUCCESS", &pollResolver{poll, field.children["poll"]}}, nil
+	return token, nil
 }
 
 type resultDraft struct {
-	State string
-	Poll  *draftResolver
+	State      string
+	Poll       *draftResolver
+	AdminToken *string
+	RetryAfter *int32
 }
 
 func (*RootResolver) NewDraft(ctx context.Context, args struct {
-	Poll newInput
+	Poll           newInput
+	IdempotencyKey *string
 }) (resultDraft, error) {
-	if len(args.Poll.Title) > 64 || len(args.Poll.Title) == 0 {
-		return resultDraft{"INVALID_TITLE", nil}, nil
+	if wait := rateLimited("new_draft", map[string]string{"ip": requestIP(ctx)}); wait > 0 {
+		return resultDraft{"RATE_LIMITED", nil, nil, retryAfter(wait)}, nil
 	}
 
-	if len(args.Poll.Options) < 2 || len(args.Poll.Options) > 15 {
-		return resultDraft{"INVALID_OPTIONS", nil}, nil
+	if args.IdempotencyKey == nil {
+		return newDraft(args.Poll)
 	}
-	for _, o := range args.Poll.Options {
-		if len(o) > 64 || len(o) == 0 {
-			return resultDraft{"INVALID_OPTIONS", nil}, nil
+
+	key := idempotencyKey(ctx, "newDraft", *args.IdempotencyKey)
+	prev, err := claimIdempotencyKey(key)
+	if err != nil {
+		return resultDraft{}, err
+	}
+	if prev != nil {
+		res := resultDraft{prev.State, nil, replayAdminToken(ctx, *args.IdempotencyKey, prev), nil}
+		if prev.ID != nil {
+			draft, err := fetchDraft(*prev.ID)
+			if err != nil {
+				return resultDraft{}, err
+			}
+			if draft != nil {
+				res.Poll = &draftResolver{draft}
+			}
 		}
+		return res, nil
 	}
 
-	var expiry int32
-	if args.Poll.Expiry != nil {
-		expiry = *args.Poll.Expiry
+	res, err := newDraft(args.Poll)
+	if err != nil {
+		releaseIdempotencyKey(key)
+		return res, err
 	}
-
-	if expiry < 60 && expiry != 0 {
-		return resultDraft{"INVALID_EXPIRY", nil}, nil
+	stored := idempotentResult{State: res.State, AdminToken: storedAdminToken(ctx, *args.IdempotencyKey, res.AdminToken)}
+	if res.Poll != nil {
+		stored.ID = &res.Poll.draft.ID
 	}
+	storeIdempotentResult(key, stored)
 
-	draft := &mongo.Draft{
-		Title:   args.Poll.Title,
-		Options: args.Poll.Options,
-	}
+	return res, nil
+}
 
-	if expiry > 0 {
-		draft.Expiry = &expiry
+func newDraft(in newInput) (resultDraft, error) {
+	if state := validateNewInput(in); state != "" {
+		return resultDraft{state, nil, nil, nil}, nil
 	}
 
-	if args.Poll.CheckIP != nil {
-		draft.CheckIP = *args.Poll.CheckIP
-	}
-	if args.Poll.MultiAnswer != nil {
-		draft.MultiAnswer = *args.Poll.MultiAnswer
+	draft := draftFromInput(in)
+	draft.Version = 1
+
+	token, hash, err := newAdminToken()
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return resultDraft{}, errInternalServer
 	}
+	draft.AdminTokenHash = hash
 
 	res, err := mongo.Database.Collection("drafts").InsertOne(mongo.Ctx, draft)
 	if err != nil {
@@ -225,5 +450,34 @@ func (*RootResolver) NewDraft(ctx context.Context, args struct {
 	} else {
 		log.Errorf("redis, err=%v", err)
 	}
-	return resultDraft{"SUCCESS", &draftResolver{draft}}, nil
+	return resultDraft{"SUCCESS", &draftResolver{draft}, &token, nil}, nil
+}
+
+// draftFromInput builds the content of a draft from an input that already passed validation.
+func draftFromInput(in newInput) *mongo.Draft {
+	draft := &mongo.Draft{
+		Title:   in.Title,
+		Type:    pollTypeStandard,
+		Options: in.Options,
+	}
+	if in.Type != nil {
+		draft.Type = *in.Type
+	}
+
+	if in.Expiry != nil && *in.Expiry > 0 {
+		draft.Expiry = in.Expiry
+	}
+	if in.OpensAt != nil && *in.OpensAt > 0 {
+		draft.OpensAt = in.OpensAt
+	}
+
+	draft.DedupMode = inputDedupMode(in)
+	draft.CheckIP = dedupStrategies[draft.DedupMode].usesIP()
+	draft.RequireChallenge = in.RequireChallenge != nil && *in.RequireChallenge
+	draft.MinSelections, draft.MaxSelections = inputSelectionBounds(in)
+	if draft.Type == pollTypeScore {
+		draft.ScoreMin, draft.ScoreMax = inputScoreRange(in)
+	}
+
+	return draft
 }
@@ -0,0 +1,346 @@
+package resolvers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ownerArgs struct {
+	ID         string
+	AdminToken string
+}
+
+type updateInput struct {
+	Title   *string
+	Options *[]string
+	Expiry  *int32
+}
+
+// newAdminToken generates an admin token and the hash of it that is stored on the poll.
+func newAdminToken() (string, string, error) {
+	token, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256(utils.S2B(token))
+	return hex.EncodeToString(h[:])
+}
+
+// tokenMatches checks an admin token against a stored hash.
+// Polls and drafts created before admin tokens existed have no hash and cannot be managed.
+func tokenMatches(hash string, token string) bool {
+	return hash != "" && subtle.ConstantTimeCompare(utils.S2B(hash), utils.S2B(hashToken(token))) == 1
+}
+
+// fetchOwnedPoll fetches a poll and checks the admin token against it, returning the failing result state if the poll is missing or the token does not match.
+func fetchOwnedPoll(args ownerArgs, field *selectedField) (*mongo.Poll, string, error) {
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		return nil, "MISSING_POLL", nil
+	}
+
+	poll, err := fetchPoll(id, field)
+	if err != nil {
+		return nil, "", err
+	}
+	if poll == nil {
+		return nil, "MISSING_POLL", nil
+	}
+
+	if !tokenMatches(poll.AdminTokenHash, args.AdminToken) {
+		return nil, "INVALID_TOKEN", nil
+	}
+
+	return poll, "", nil
+}
+
+// updateOwnedPoll applies an update to a poll, invalidating the cached copy and returning the updated poll.
+func updateOwnedPoll(ctx context.Context, id primitive.ObjectID, update bson.M) (*pollResolver, error) {
+	r, err := updatePollWhere(ctx, bson.M{
+		"_id": id,
+	}, update)
+	if err == nil && r == nil {
+		log.Errorf("mongo, err=%v", mongo.ErrNoDocuments)
+		return nil, errInternalServer
+	}
+	return r, err
+}
+
+// updatePollWhere applies an update to the poll matching filter like updateOwnedPoll, returning nil if no poll matches.
+func updatePollWhere(ctx context.Context, filter bson.M, update bson.M) (*pollResolver, error) {
+	res := mongo.Database.Collection("polls").FindOneAndUpdate(mongo.Ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	poll := &mongo.Poll{}
+	err := res.Err()
+	if err == nil {
+		err = res.Decode(poll)
+	}
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	invalidatePoll(poll.ID)
+
+	return &pollResolver{poll, generateSelectedFieldMap(ctx).children["poll"]}, nil
+}
+
+func invalidatePoll(id primitive.ObjectID) {
+	if err := redis.Client.Del(redis.Ctx, fmt.Sprintf("cached:polls:%s", id.Hex())).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+// pollHasVotes reports if any ballot has been counted on a poll, including quarantined ballots.
+func pollHasVotes(id primitive.ObjectID) (bool, error) {
+	pipe := redis.Client.Pipeline()
+	votesCmd := pipe.HLen(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", id.Hex()))
+	quarantineCmd := pipe.HLen(redis.Ctx, fmt.Sprintf("poll:votes:%s:quarantine:options", id.Hex()))
+	if _, err := pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+		return false, errInternalServer
+	}
+	return votesCmd.Val() > 0 || quarantineCmd.Val() > 0, nil
+}
+
+func (*RootResolver) ClosePoll(ctx context.Context, args ownerArgs) (result, error) {
+	poll, state, err := fetchOwnedPoll(args, nil)
+	if err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	if !poll.Closed {
+		now := time.Now()
+		if err = finalizePoll(poll, "closed", now); err != nil {
+			log.Errorf("lifecycle, err=%v", err)
+			return result{}, errInternalServer
+		}
+		poll.Closed = true
+		poll.ClosedAt = &now
+	}
+
+	return result{"SUCCESS", &pollResolver{poll, generateSelectedFieldMap(ctx).children["poll"]}, nil, nil}, nil
+}
+
+func (*RootResolver) ReopenPoll(ctx context.Context, args struct {
+	ID         string
+	AdminToken string
+	Expiry     *int32
+}) (result, error) {
+	poll, state, err := fetchOwnedPoll(ownerArgs{args.ID, args.AdminToken}, nil)
+	if err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	set := bson.M{
+		"closed":    false,
+		"closed_at": nil,
+	}
+	if args.Expiry != nil {
+		if *args.Expiry < 60 && *args.Expiry != 0 {
+			return result{"INVALID_EXPIRY", nil, nil, nil}, nil
+		}
+		if *args.Expiry == 0 {
+			set["expiry"] = nil
+		} else {
+			set["expiry"] = time.Now().Add(time.Duration(*args.Expiry) * time.Second)
+		}
+	} else if poll.Expiry != nil && poll.Expiry.Before(time.Now()) {
+		return result{"EXPIRED", nil, nil, nil}, nil
+	}
+
+	// Only the request that actually reopens the poll tells its watchers, reopening an open poll just updates its expiry.
+	r, err := updatePollWhere(ctx, bson.M{
+		"_id":    poll.ID,
+		"closed": true,
+	}, bson.M{
+		"$set": set,
+	})
+	if err != nil {
+		return result{}, err
+	}
+	reopened := r != nil
+	if !reopened {
+		if r, err = updateOwnedPoll(ctx, poll.ID, bson.M{
+			"$set": set,
+		}); err != nil {
+			return result{}, err
+		}
+	}
+	if err = redis.Client.Del(redis.Ctx, closedMarkerKey(poll.ID)).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+		return result{}, errInternalServer
+	}
+	scheduleExpiry(r.poll)
+	if reopened {
+		if err = publishPollEvent("reopened", r.poll, PollReopened{
+			At:     time.Now(),
+			Expiry: r.poll.Expiry,
+		}); err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+	}
+
+	return result{"SUCCESS", r, nil, nil}, nil
+}
+
+func (*RootResolver) UpdatePoll(ctx context.Context, args struct {
+	ID         string
+	AdminToken string
+	Poll       updateInput
+}) (result, error) {
+	poll, state, err := fetchOwnedPoll(ownerArgs{args.ID, args.AdminToken}, nil)
+	if err != nil || state != "" {
+		return result{state, nil, nil, nil}, err
+	}
+
+	set := bson.M{}
+
+	if args.Poll.Title != nil {
+		if len(*args.Poll.Title) > 64 || len(*args.Poll.Title) == 0 {
+			return result{"INVALID_TITLE", nil, nil, nil}, nil
+		}
+		set["title"] = *args.Poll.Title
+	}
+
+	if args.Poll.Options != nil {
+		opts := *args.Poll.Options
+		if len(opts) < len(poll.OptionsRaw) || len(opts) > 15 {
+			return result{"INVALID_OPTIONS", nil, nil, nil}, nil
+		}
+		for _, o := range opts {
+			if len(o) > 64 || len(o) == 0 {
+				return result{"INVALID_OPTIONS", nil, nil, nil}, nil
+			}
+		}
+
+		// Once votes are in, options can only be appended to standard and ranked polls so no ballot changes meaning.
+		hasVotes, err := pollHasVotes(poll.ID)
+		if err != nil {
+			return result{}, err
+		}
+		if hasVotes {
+			if pollType(poll) == pollTypeScore && len(opts) != len(poll.OptionsRaw) {
+				return result{"OPTIONS_LOCKED", nil, nil, nil}, nil
+			}
+			for i, o := range poll.OptionsRaw {
+				if opts[i] != o {
+					return result{"OPTIONS_LOCKED", nil, nil, nil}, nil
+				}
+			}
+		}
+
+		set["options"] = opts
+		if pollType(poll) == pollTypeScore {
+			set["min_selections"] = len(opts)
+			set["max_selections"] = len(opts)
+		}
+	}
+
+	if args.Poll.Expiry != nil {
+		if *args.Poll.Expiry < 60 && *args.Poll.Expiry != 0 {
+			return result{"INVALID_EXPIRY", nil, nil, nil}, nil
+		}
+		if *args.Poll.Expiry == 0 {
+			set["expiry"] = nil
+		} else {
+			set["expiry"] = time.Now().Add(time.Duration(*args.Poll.Expiry) * time.Second)
+		}
+	}
+
+	if len(set) == 0 {
+		return result{"SUCCESS", &pollResolver{poll, generateSelectedFieldMap(ctx).children["poll"]}, nil, nil}, nil
+	}
+
+	r, err := updateOwnedPoll(ctx, poll.ID, bson.M{
+		"$set": set,
+	})
+	if err != nil {
+		return result{}, err
+	}
+	scheduleExpiry(r.poll)
+	if err = publishPollEvent("edited", r.poll, PollEdited{
+		At:      time.Now(),
+		Title:   r.poll.Title,
+		Options: r.poll.OptionsRaw,
+		Expiry:  r.poll.Expiry,
+	}); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	return result{"SUCCESS", r, nil, nil}, nil
+}
+
+func (*RootResolver) DeletePoll(ctx context.Context, args ownerArgs) (string, error) {
+	poll, state, err := fetchOwnedPoll(args, nil)
+	if err != nil || state != "" {
+		return state, err
+	}
+
+	if _, err = mongo.Database.Collection("polls").DeleteOne(mongo.Ctx, bson.M{
+		"_id": poll.ID,
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return "", errInternalServer
+	}
+
+	if err = redis.Client.Set(redis.Ctx, fmt.Sprintf("cached:polls:%s", poll.ID.Hex()), "dead", time.Hour*6).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	keys := append(voteHashKeys(poll.ID.Hex()), fmt.Sprintf("poll:votes:%s:ips", poll.ID.Hex()))
+	if err = redis.Client.Del(redis.Ctx, keys...).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	if err = redis.Client.ZRem(redis.Ctx, lifecycleJobs, expireJob(poll.ID)).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	// Queued ballots are purged before the ballot log, the lifecycle worker also drops any it already took as it finds the poll gone.
+	if err = purgeOutbox(poll.ID); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+	if _, err = mongo.Database.Collection("pollanswers").DeleteMany(mongo.Ctx, bson.M{
+		"poll_id": poll.ID,
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+	}
+	if _, err = mongo.Database.Collection("ballottree").DeleteMany(mongo.Ctx, bson.M{
+		"poll_id": poll.ID,
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+	}
+	evictLedgerHead(poll.ID)
+
+	if err = publishPollEvent("deleted", poll, PollDeleted{
+		At: time.Now(),
+	}); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+	// The events of a deleted poll are not kept for replays, its watchers were just told it is gone.
+	if err = redis.Client.Del(redis.Ctx, eventSeqKey(poll.ID), eventStreamKey(poll.ID), closedMarkerKey(poll.ID)).Err(); err != nil {
+		log.Errorf("redis, err=%v", err)
+	}
+
+	return "SUCCESS", nil
+}
@@ -0,0 +1,242 @@
+package resolvers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+)
+
+const (
+	pollTypeStandard = "STANDARD"
+	pollTypeRanked   = "RANKED"
+	pollTypeScore    = "SCORE"
+)
+
+// pollType returns the type of a poll, polls created before poll types existed are standard polls.
+func pollType(poll *mongo.Poll) string {
+	if poll.Type == "" {
+		return pollTypeStandard
+	}
+	return poll.Type
+}
+
+const (
+	pollStatusScheduled = "SCHEDULED"
+	pollStatusOpen      = "OPEN"
+	pollStatusClosed    = "CLOSED"
+	pollStatusExpired   = "EXPIRED"
+)
+
+// pollStatus returns whether a poll is accepting votes right now, and if not why.
+func pollStatus(poll *mongo.Poll) string {
+	now := time.Now()
+	if poll.Expiry != nil && poll.Expiry.Before(now) {
+		return pollStatusExpired
+	}
+	if poll.Closed {
+		return pollStatusClosed
+	}
+	if poll.OpensAt != nil && poll.OpensAt.After(now) {
+		return pollStatusScheduled
+	}
+	return pollStatusOpen
+}
+
+// selectionBounds returns the minimum and maximum number of options a single ballot may select.
+// Polls created before selection limits existed fall back to their multi answer flag.
+func selectionBounds(typ string, multiAnswer bool, min, max int32, options int) (int32, int32) {
+	if typ == pollTypeScore {
+		return int32(options), int32(options)
+	}
+	if max == 0 {
+		max = 1
+		if multiAnswer || typ == pollTypeRanked {
+			max = int32(options)
+		}
+	}
+	if min == 0 {
+		min = 1
+	}
+	return min, max
+}
+
+func pollSelectionBounds(poll *mongo.Poll) (int32, int32) {
+	return selectionBounds(pollType(poll), poll.MultiAnswer, poll.MinSelections, poll.MaxSelections, len(poll.OptionsRaw))
+}
+
+// tallyIncrements returns the increments a ballot adds to the options and scores vote hashes of a poll.
+// The options hash counts ballots per option index, the scores hash holds the sum of the scores per option
+// as "sum:<index>" and the number of ballots per score as "hist:<index>:<score>".
+func tallyIncrements(poll *mongo.Poll, selection []int32) (map[string]int64, map[string]int64) {
+	options := map[string]int64{}
+	scores := map[string]int64{}
+	if pollType(poll) == pollTypeScore {
+		for i, s := range selection {
+			options[fmt.Sprint(i)]++
+			scores[fmt.Sprintf("sum:%d", i)] += int64(s)
+			scores[fmt.Sprintf("hist:%d:%d", i, s)]++
+		}
+		return options, scores
+	}
+	for _, s := range countedSelection(poll, selection) {
+		options[fmt.Sprint(s)]++
+	}
+	return options, scores
+}
+
+// clonePoll copies a poll along with its options, so votes applied to the copy do not change the original.
+func clonePoll(poll *mongo.Poll) *mongo.Poll {
+	c := *poll
+	if poll.Options != nil {
+		options := make([]mongo.PollOption, len(*poll.Options))
+		copy(options, *poll.Options)
+		for i, o := range options {
+			if o.Histogram != nil {
+				histogram := append([]int32(nil), *o.Histogram...)
+				options[i].Histogram = &histogram
+			}
+		}
+		c.Options = &options
+	}
+	return &c
+}
+
+// applyVote adds a ballot to options already built for the poll.
+func applyVote(poll *mongo.Poll, options []mongo.PollOption, selection []int32) {
+	if pollType(poll) != pollTypeScore {
+		for _, s := range countedSelection(poll, selection) {
+			if s >= 0 && int(s) < len(options) {
+				options[s].Votes++
+			}
+		}
+		return
+	}
+
+	for i, s := range selection {
+		if i >= len(options) || s < poll.ScoreMin || s > poll.ScoreMax {
+			continue
+		}
+		o := &options[i]
+		avg := float64(s)
+		if o.Average != nil {
+			avg = (*o.Average*float64(o.Count) + float64(s)) / float64(o.Count+1)
+		}
+		o.Average = &avg
+		o.Votes++
+		o.Count++
+		if o.Histogram != nil {
+			(*o.Histogram)[s-poll.ScoreMin]++
+		}
+	}
+}
+
+// unapplyVote takes a ballot back out of options it was applied to, the reverse of applyVote.
+func unapplyVote(poll *mongo.Poll, options []mongo.PollOption, selection []int32) {
+	if pollType(poll) != pollTypeScore {
+		for _, s := range countedSelection(poll, selection) {
+			if s >= 0 && int(s) < len(options) && options[s].Votes > 0 {
+				options[s].Votes--
+			}
+		}
+		return
+	}
+
+	for i, s := range selection {
+		if i >= len(options) || s < poll.ScoreMin || s > poll.ScoreMax || options[i].Count == 0 {
+			continue
+		}
+		o := &options[i]
+		if o.Count == 1 || o.Average == nil {
+			o.Average = nil
+		} else {
+			avg := (*o.Average*float64(o.Count) - float64(s)) / float64(o.Count-1)
+			o.Average = &avg
+		}
+		o.Votes--
+		o.Count--
+		if o.Histogram != nil && (*o.Histogram)[s-poll.ScoreMin] > 0 {
+			(*o.Histogram)[s-poll.ScoreMin]--
+		}
+	}
+}
+
+// buildOptions builds the options of a poll from the raw values of its options and scores vote hashes, either may be nil.
+// If redis has no votes for a poll that has a snapshot of its results, the snapshot is used until the tally is rebuilt.
+func buildOptions(poll *mongo.Poll, votes map[string]string, scores map[string]string) ([]mongo.PollOption, error) {
+	if len(votes) == 0 && poll.Results != nil && len(*poll.Results) == len(poll.OptionsRaw) {
+		options := make([]mongo.PollOption, len(poll.OptionsRaw))
+		copy(options, *poll.Results)
+		for i, v := range poll.OptionsRaw {
+			options[i].Title = v
+		}
+		return options, nil
+	}
+
+	options := make([]mongo.PollOption, len(poll.OptionsRaw))
+	score := pollType(poll) == pollTypeScore
+
+	for i, v := range poll.OptionsRaw {
+		var voteCount int32
+		if votes != nil {
+			if count, ok := votes[fmt.Sprint(i)]; ok {
+				tVal, err := strconv.ParseInt(count, 10, 32)
+				if err != nil {
+					return nil, err
+				}
+				voteCount = int32(tVal)
+			}
+		}
+		options[i] = mongo.PollOption{
+			Title: v,
+			Votes: voteCount,
+			Count: voteCount,
+		}
+
+		if !score {
+			continue
+		}
+
+		histogram := make([]int32, poll.ScoreMax-poll.ScoreMin+1)
+		if scores != nil {
+			for s := range histogram {
+				if count, ok := scores[fmt.Sprintf("hist:%d:%d", i, int32(s)+poll.ScoreMin)]; ok {
+					tVal, err := strconv.ParseInt(count, 10, 32)
+					if err != nil {
+						return nil, err
+					}
+					histogram[s] = int32(tVal)
+				}
+			}
+			if sum, ok := scores[fmt.Sprintf("sum:%d", i)]; ok && voteCount > 0 {
+				tVal, err := strconv.ParseInt(sum, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				avg := float64(tVal) / float64(voteCount)
+				options[i].Average = &avg
+			}
+		}
+		options[i].Histogram = &histogram
+	}
+
+	return options, nil
+}
+
+// wantsTally reports if the selected poll fields need the vote hashes of the poll.
+func wantsTally(field *selectedField) bool {
+	if field == nil {
+		return false
+	}
+	v, ok := field.children["options"]
+	if !ok {
+		return false
+	}
+	for _, f := range []string{"votes", "count", "average", "histogram"} {
+		if _, ok := v.children[f]; ok {
+			return true
+		}
+	}
+	return false
+}
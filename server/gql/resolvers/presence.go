@@ -0,0 +1,139 @@
+package resolvers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Every instance counts its own watchers per poll and writes the counts into the poll:watchers:<id> hash, as the field
+// node:<instance> holding "<count> <expires at in unix ms>". Changed counts are written every second and every count is
+// renewed every heartbeat, counts of instances that stop renewing them expire. The total field holds the sum of the counts
+// that have not expired, and every change to it is published on events:poll:watchers:<id>.
+const (
+	watcherFlush     = time.Second
+	watcherHeartbeat = 10 * time.Second
+	watcherTTL       = 3 * watcherHeartbeat
+)
+
+// watcherScript writes the count of an instance, drops expired counts and updates the total, publishing it if it changed.
+//
+// KEYS: watchers hash
+// ARGV: instance field, count, ttl in ms, event channel
+var watcherScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+if tonumber(ARGV[2]) > 0 then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2] .. " " .. (now + tonumber(ARGV[3])))
+else
+	redis.call("HDEL", KEYS[1], ARGV[1])
+end
+local prev = 0
+local total = 0
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+	if fields[i] == "total" then
+		prev = tonumber(fields[i + 1])
+	else
+		local count, expires = string.match(fields[i + 1], "^(%d+) (%d+)$")
+		if count == nil or tonumber(expires) <= now then
+			redis.call("HDEL", KEYS[1], fields[i])
+		else
+			total = total + tonumber(count)
+		end
+	end
+end
+if total == 0 then
+	redis.call("DEL", KEYS[1])
+else
+	redis.call("HSET", KEYS[1], "total", total)
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+if total ~= prev then
+	redis.call("PUBLISH", ARGV[4], total)
+end
+return total
+`)
+
+type watcherPresence struct {
+	mtx    sync.Mutex
+	counts map[primitive.ObjectID]int64
+	dirty  map[primitive.ObjectID]bool
+}
+
+var presence = &watcherPresence{
+	counts: map[primitive.ObjectID]int64{},
+	dirty:  map[primitive.ObjectID]bool{},
+}
+
+// add changes the number of watchers of a poll on this instance.
+func (p *watcherPresence) add(id primitive.ObjectID, n int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.counts[id] += n
+	p.dirty[id] = true
+}
+
+// take returns the counts to write, either the changed ones or all of them, forgetting polls nobody watches anymore.
+func (p *watcherPresence) take(all bool) map[primitive.ObjectID]int64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	counts := map[primitive.ObjectID]int64{}
+	for id, n := range p.counts {
+		if all || p.dirty[id] {
+			counts[id] = n
+		}
+		if n <= 0 {
+			delete(p.counts, id)
+		}
+	}
+	p.dirty = map[primitive.ObjectID]bool{}
+	return counts
+}
+
+func runPresence() {
+	node, err := utils.GenerateRandomString(16)
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return
+	}
+	field := fmt.Sprintf("node:%s", node)
+
+	tick := time.NewTicker(watcherFlush)
+	defer tick.Stop()
+
+	var lastHeartbeat time.Time
+	for now := range tick.C {
+		all := now.Sub(lastHeartbeat) >= watcherHeartbeat
+		if all {
+			lastHeartbeat = now
+		}
+		for id, n := range presence.take(all) {
+			if err = watcherScript.Run(redis.Ctx, redis.Client, []string{fmt.Sprintf("poll:watchers:%s", id.Hex())},
+				field, n, watcherTTL.Milliseconds(), fmt.Sprintf("events:poll:watchers:%s", id.Hex())).Err(); err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+		}
+	}
+}
+
+// parseWatchers reads the total of a watchers hash, polls nobody watches have no hash.
+func parseWatchers(total string) int32 {
+	n, _ := strconv.ParseInt(total, 10, 32)
+	return int32(n)
+}
+
+func wantsWatchers(field *selectedField) bool {
+	if field == nil {
+		return false
+	}
+	_, ok := field.children["watchers"]
+	return ok
+}
@@ -3,13 +3,12 @@ package resolvers
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/challenge"
 	"github.com/troydota/api.poll.komodohype.dev/mongo"
 	"github.com/troydota/api.poll.komodohype.dev/redis"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -32,59 +31,11 @@ func (*RootResolver) Poll(ctx context.Context, args struct{ ID string }) (*pollR
 	return &pollResolver{poll, field}, nil
 }
 
-func (*RootResolver) Draft(ctx context.Context, args struct{ ID string }) (*draftResolver, error) {
-	id, err := primitive.ObjectIDFromHex(args.ID)
-	if err != nil {
-		return nil, nil
-	}
-
-	redisKey := fmt.Sprintf("cached:drafts:%s", id.Hex())
-
-	val, err := redis.Client.Get(redis.Ctx, redisKey).Result()
-	if err != nil && err != redis.ErrNil {
-		log.Errorf("redis, err=%v", err)
-		return nil, errInternalServer
-	}
-
-	if val == "dead" {
-		return nil, nil
-	}
-
-	draft := &mongo.Draft{}
-	if err == redis.ErrNil {
-		result := mongo.Database.Collection("drafts").FindOne(mongo.Ctx, bson.M{
-			"_id": id,
-		})
-		err = result.Err()
-		if err == mongo.ErrNoDocuments {
-			if err = redis.Client.Set(redis.Ctx, redisKey, "dead", time.Hour*6).Err(); err != nil {
-				log.Errorf("redis, err=%v", err)
-			}
-			return nil, nil
-		}
-		if err == nil {
-			err = result.Decode(draft)
-		}
-		if err != nil {
-			log.Errorf("mongo, err=%v", err)
-			return nil, errInternalServer
-		}
-
-		draftStr, err := json.MarshalToString(draft)
-		if err == nil {
-			if err = redis.Client.Set(redis.Ctx, redisKey, draftStr, time.Hour*6).Err(); err != nil {
-				log.Errorf("redis, err=%v", err)
-			}
-		} else {
-			log.Errorf("redis, err=%v", err)
-		}
-	} else if err = json.UnmarshalFromString(val, draft); err != nil {
-		log.Errorf("json, err=%v", err)
-		return nil, errInternalServer
-	}
-
-	if draft == nil {
-		return nil, nil
+// Draft returns a draft to its owner, a draft is not public until it is published.
+func (*RootResolver) Draft(ctx context.Context, args ownerArgs) (*draftResolver, error) {
+	draft, state, err := fetchOwnedDraft(args)
+	if err != nil || state != "" {
+		return nil, err
 	}
 
 	return &draftResolver{draft}, nil
@@ -103,40 +54,28 @@ func (r *pollResolver) Title() string {
 	return r.poll.Title
 }
 
+func (r *pollResolver) Type() string {
+	return pollType(r.poll)
+}
+
 func (r *pollResolver) Options() ([]mongo.PollOption, error) {
 	if r.poll.Options == nil {
-		var votes map[string]string
+		var votes, scores map[string]string
 		var err error
-		options := make([]mongo.PollOption, len(r.poll.OptionsRaw))
-		if r.field != nil {
-			if _, ok := r.field.children["options"].children["votes"]; ok {
-				votes, err = redis.Client.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", r.poll.ID.Hex())).Result()
-				if err != nil {
-					if err == redis.ErrNil {
-						votes = nil
-					} else {
-						log.Errorf("redis, err=%v", err)
-						return nil, errInternalServer
-					}
-				}
+		if wantsTally(r.field) {
+			pipe := redis.Client.Pipeline()
+			votesCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", r.poll.ID.Hex()))
+			scoresCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:scores", r.poll.ID.Hex()))
+			if _, err = pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+				log.Errorf("redis, err=%v", err)
+				return nil, errInternalServer
 			}
+			votes, scores = votesCmd.Val(), scoresCmd.Val()
 		}
 
-		for i, v := range r.poll.OptionsRaw {
-			var voteCount int32
-			if votes != nil {
-				if count, ok := votes[fmt.Sprint(i)]; ok {
-					tVal, err := strconv.ParseInt(count, 10, 32)
-					if err != nil {
-						return nil, err
-					}
-					voteCount = int32(tVal)
-				}
-			}
-			options[i] = mongo.PollOption{
-				Title: v,
-				Votes: voteCount,
-			}
+		options, err := buildOptions(r.poll, votes, scores)
+		if err != nil {
+			return nil, err
 		}
 		r.poll.Options = &options
 	}
@@ -144,11 +83,56 @@ func (r *pollResolver) Options() ([]mongo.PollOption, error) {
 }
 
 func (r *pollResolver) CheckIP() bool {
-	return r.poll.CheckIP
+	return dedupStrategies[pollDedupMode(r.poll)].usesIP()
+}
+
+func (r *pollResolver) DedupMode() string {
+	return pollDedupMode(r.poll)
+}
+
+func (r *pollResolver) RequireChallenge() bool {
+	return challenge.Default != nil && (r.poll.RequireChallenge || challenge.Required())
 }
 
 func (r *pollResolver) MultiAnswer() bool {
-	return r.poll.MultiAnswer
+	_, max := pollSelectionBounds(r.poll)
+	return max > 1
+}
+
+func (r *pollResolver) MinSelections() int32 {
+	min, _ := pollSelectionBounds(r.poll)
+	return min
+}
+
+func (r *pollResolver) MaxSelections() int32 {
+	_, max := pollSelectionBounds(r.poll)
+	return max
+}
+
+func (r *pollResolver) ScoreMin() *int32 {
+	if pollType(r.poll) != pollTypeScore {
+		return nil
+	}
+	return &r.poll.ScoreMin
+}
+
+func (r *pollResolver) ScoreMax() *int32 {
+	if pollType(r.poll) != pollTypeScore {
+		return nil
+	}
+	return &r.poll.ScoreMax
+}
+
+func (r *pollResolver) OpensAt() *string {
+	if r.poll.OpensAt == nil {
+		return nil
+	}
+	s := r.poll.OpensAt.Format(time.RFC3339)
+	return &s
+}
+
+func (r *pollResolver) Status() string {
+	return pollStatus(r.poll)
 }
 
 func (r *pollResolver) Expiry() *string {
@@ -159,6 +143,44 @@ func (r *pollResolver) Expiry() *string {
 	return &s
 }
 
+func (r *pollResolver) Closed() bool {
+	return r.poll.Closed
+}
+
+func (r *pollResolver) DraftID() *string {
+	if r.poll.DraftID == nil {
+		return nil
+	}
+	s := r.poll.DraftID.Hex()
+	return &s
+}
+
+func (r *pollResolver) Watchers() (int32, error) {
+	if r.poll.Watchers != nil {
+		return *r.poll.Watchers, nil
+	}
+
+	total, err := redis.Client.HGet(redis.Ctx, fmt.Sprintf("poll:watchers:%s", r.poll.ID.Hex()), "total").Result()
+	if err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+		return 0, errInternalServer
+	}
+	return parseWatchers(total), nil
+}
+
+func (r *pollResolver) Seq() (int32, error) {
+	if r.poll.Seq != nil {
+		return int32(*r.poll.Seq), nil
+	}
+
+	seq, err := redis.Client.Get(redis.Ctx, eventSeqKey(r.poll.ID)).Result()
+	if err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+		return 0, errInternalServer
+	}
+	return int32(pollSeq(r.poll, seq)), nil
+}
+
 func (r *pollResolver) CreatedAt() string {
 	return r.poll.ID.Timestamp().Format(time.RFC3339)
 }
@@ -175,22 +197,97 @@ func (r *draftResolver) Title() string {
 	return r.draft.Title
 }
 
+func (r *draftResolver) Type() string {
+	if r.draft.Type == "" {
+		return pollTypeStandard
+	}
+	return r.draft.Type
+}
+
 func (r *draftResolver) Options() []string {
 	return r.draft.Options
 }
 
 func (r *draftResolver) CheckIP() bool {
-	return r.draft.CheckIP
+	return dedupStrategies[draftDedupMode(r.draft)].usesIP()
+}
+
+func (r *draftResolver) DedupMode() string {
+	return draftDedupMode(r.draft)
+}
+
+func (r *draftResolver) RequireChallenge() bool {
+	return r.draft.RequireChallenge
 }
 
 func (r *draftResolver) MultiAnswer() bool {
-	return r.draft.MultiAnswer
+	_, max := r.selectionBounds()
+	return max > 1
+}
+
+func (r *draftResolver) MinSelections() int32 {
+	min, _ := r.selectionBounds()
+	return min
+}
+
+func (r *draftResolver) MaxSelections() int32 {
+	_, max := r.selectionBounds()
+	return max
+}
+
+func (r *draftResolver) selectionBounds() (int32, int32) {
+	return selectionBounds(r.Type(), r.draft.MultiAnswer, r.draft.MinSelections, r.draft.MaxSelections, len(r.draft.Options))
+}
+
+func (r *draftResolver) ScoreMin() *int32 {
+	if r.Type() != pollTypeScore {
+		return nil
+	}
+	return &r.draft.ScoreMin
+}
+
+func (r *draftResolver) ScoreMax() *int32 {
+	if r.Type() != pollTypeScore {
+		return nil
+	}
+	return &r.draft.ScoreMax
+}
+
+func (r *draftResolver) OpensAt() *int32 {
+	return r.draft.OpensAt
 }
 
 func (r *draftResolver) Expiry() *int32 {
 	return r.draft.Expiry
 }
 
+func (r *draftResolver) Published() int32 {
+	return r.draft.Published
+}
+
+func (r *draftResolver) LastPollID() *string {
+	if r.draft.LastPollID == nil {
+		return nil
+	}
+	s := r.draft.LastPollID.Hex()
+	return &s
+}
+
+func (r *draftResolver) Version() int32 {
+	if r.draft.Version == 0 {
+		return 1
+	}
+	return r.draft.Version
+}
+
+func (r *draftResolver) UpdatedAt() *string {
+	if r.draft.UpdatedAt == nil {
+		return nil
+	}
+	s := r.draft.UpdatedAt.Format(time.RFC3339)
+	return &s
+}
+
 func (r *draftResolver) CreatedAt() string {
 	return r.draft.ID.Timestamp().Format(time.RFC3339)
 }
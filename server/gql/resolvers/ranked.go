@@ -0,0 +1,231 @@
+package resolvers
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// countedSelection returns the option indexes a ballot adds a vote to in the live tally.
+// Ranked ballots only count towards their first preference, the full ballot is counted by instant-runoff.
+func countedSelection(poll *mongo.Poll, selection []int32) []int32 {
+	if pollType(poll) == pollTypeRanked {
+		return selection[:1]
+	}
+	return selection
+}
+
+type rankedResult struct {
+	Winner  *int32
+	Ballots int32
+	Rounds  []rankedRound
+}
+
+type rankedRound struct {
+	Round      int32
+	Tallies    []int32
+	Exhausted  int32
+	Eliminated *int32
+	Transfers  []rankedTransfer
+}
+
+type rankedTransfer struct {
+	To    *int32
+	Votes int32
+}
+
+// rankedCache is the instant-runoff result of a poll as of the ballot log entry at Seq. Ballots only reach mongo through the log,
+// so the result holds until the log grows, which saves recounting every ballot on each read.
+type rankedCache struct {
+	Seq     int32
+	Options int
+	Result  *rankedResult
+}
+
+func (r *pollResolver) RankedResult() (*rankedResult, error) {
+	if pollType(r.poll) != pollTypeRanked {
+		return nil, nil
+	}
+
+	head, err := readLedgerHead(r.poll.ID)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	redisKey := fmt.Sprintf("cached:ranked:%s", r.poll.ID.Hex())
+	val, err := redis.Client.Get(redis.Ctx, redisKey).Result()
+	if err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+	}
+	if val != "" {
+		cached := rankedCache{}
+		if err = json.UnmarshalFromString(val, &cached); err == nil && cached.Seq == head.Seq && cached.Options == len(r.poll.OptionsRaw) && cached.Result != nil {
+			return cached.Result, nil
+		}
+	}
+
+	ballots, err := fetchBallots(r.poll.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := instantRunoff(len(r.poll.OptionsRaw), ballots)
+
+	// Ballots written after the head was read may be in the count, caching it under the older head only means it is counted again.
+	if val, err = json.MarshalToString(rankedCache{head.Seq, len(r.poll.OptionsRaw), res}); err == nil {
+		if err = redis.Client.Set(redis.Ctx, redisKey, val, time.Hour*6).Err(); err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+	}
+	return res, nil
+}
+
+// fetchBallots returns the selections of the ballots counted in the public tally of a poll, quarantined ballots are left out like in the live tally.
+func fetchBallots(id primitive.ObjectID) ([][]int32, error) {
+	lastRelease, err := fetchLastRelease(id)
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+		"poll_id": id,
+		"kind":    bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"flags": bson.M{"$exists": false}},
+			bson.M{"seq": bson.M{"$lte": lastRelease}},
+		},
+	}, options.Find().SetProjection(bson.M{"answer": 1}).SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	answers := []mongo.PollAnswer{}
+	if err = cur.All(mongo.Ctx, &answers); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	ballots := make([][]int32, len(answers))
+	for i, a := range answers {
+		ballots[i] = a.Answer
+	}
+	return ballots, nil
+}
+
+// instantRunoff counts ranked ballots over the given number of options.
+// Each round every ballot counts for its highest ranked option still in the race, an option with more than half of the
+// non exhausted ballots wins, otherwise the option with the fewest ballots is eliminated and its ballots transfer to their next preference.
+// Ties for elimination are broken by the most recent earlier round where the tied options differ, then by eliminating the last listed option.
+func instantRunoff(options int, ballots [][]int32) *rankedResult {
+	res := &rankedResult{
+		Ballots: int32(len(ballots)),
+		Rounds:  []rankedRound{},
+	}
+	if len(ballots) == 0 || options == 0 {
+		return res
+	}
+
+	eliminated := make([]bool, options)
+	remaining := options
+	// pos holds the index of the preference each ballot is currently counted for.
+	pos := make([]int, len(ballots))
+	// advance moves a ballot past eliminated or invalid preferences, returning the option it counts for or -1 if exhausted.
+	advance := func(i int) int {
+		b := ballots[i]
+		for pos[i] < len(b) && (b[pos[i]] < 0 || int(b[pos[i]]) >= options || eliminated[b[pos[i]]]) {
+			pos[i]++
+		}
+		if pos[i] < len(b) {
+			return int(b[pos[i]])
+		}
+		return -1
+	}
+
+	history := [][]int32{}
+
+	for {
+		round := rankedRound{
+			Round:     int32(len(res.Rounds) + 1),
+			Tallies:   make([]int32, options),
+			Transfers: []rankedTransfer{},
+		}
+		for i := range ballots {
+			if o := advance(i); o != -1 {
+				round.Tallies[o]++
+			} else {
+				round.Exhausted++
+			}
+		}
+
+		active := res.Ballots - round.Exhausted
+		if active == 0 {
+			res.Rounds = append(res.Rounds, round)
+			return res
+		}
+
+		leader := -1
+		for o, v := range round.Tallies {
+			if !eliminated[o] && (leader == -1 || v > round.Tallies[leader]) {
+				leader = o
+			}
+		}
+		if round.Tallies[leader]*2 > active || remaining == 1 {
+			winner := int32(leader)
+			res.Winner = &winner
+			res.Rounds = append(res.Rounds, round)
+			return res
+		}
+
+		loser := -1
+		for o := options - 1; o >= 0; o-- {
+			if eliminated[o] {
+				continue
+			}
+			if loser == -1 || round.Tallies[o] < round.Tallies[loser] {
+				loser = o
+			} else if round.Tallies[o] == round.Tallies[loser] {
+				for h := len(history) - 1; h >= 0; h-- {
+					if history[h][o] != history[h][loser] {
+						if history[h][o] < history[h][loser] {
+							loser = o
+						}
+						break
+					}
+				}
+			}
+		}
+
+		eliminated[loser] = true
+		remaining--
+		l := int32(loser)
+		round.Eliminated = &l
+
+		transfers := map[int]int32{}
+		for i, b := range ballots {
+			if pos[i] < len(b) && int(b[pos[i]]) == loser {
+				transfers[advance(i)]++
+			}
+		}
+		for o := -1; o < options; o++ {
+			if v, ok := transfers[o]; ok {
+				t := rankedTransfer{Votes: v}
+				if o != -1 {
+					to := int32(o)
+					t.To = &to
+				}
+				round.Transfers = append(round.Transfers, t)
+			}
+		}
+
+		history = append(history, round.Tallies)
+		res.Rounds = append(res.Rounds, round)
+	}
+}
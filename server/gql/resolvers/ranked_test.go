@@ -0,0 +1,144 @@
+package resolvers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstantRunoff(t *testing.T) {
+	// winner and eliminated use -1 for none.
+	tests := []struct {
+		name       string
+		options    int
+		ballots    [][]int32
+		winner     int32
+		tallies    [][]int32
+		exhausted  []int32
+		eliminated []int32
+	}{
+		{
+			name:       "no ballots",
+			options:    3,
+			ballots:    [][]int32{},
+			winner:     -1,
+			tallies:    [][]int32{},
+			exhausted:  []int32{},
+			eliminated: []int32{},
+		},
+		{
+			name:       "majority in the first round",
+			options:    3,
+			ballots:    [][]int32{{0, 1}, {0}, {0, 2}, {1}, {2}},
+			winner:     0,
+			tallies:    [][]int32{{3, 1, 1}},
+			exhausted:  []int32{0},
+			eliminated: []int32{-1},
+		},
+		{
+			name:       "tie without history eliminates the last listed option",
+			options:    2,
+			ballots:    [][]int32{{0}, {1}},
+			winner:     0,
+			tallies:    [][]int32{{1, 1}, {1, 0}},
+			exhausted:  []int32{0, 1},
+			eliminated: []int32{1, -1},
+		},
+		{
+			name:    "tie broken by the earlier round",
+			options: 4,
+			ballots: [][]int32{
+				{0}, {0}, {0}, {0}, {0},
+				{1}, {1},
+				{2}, {2}, {2},
+				{3, 1},
+			},
+			winner:     0,
+			tallies:    [][]int32{{5, 2, 3, 1}, {5, 3, 3, 0}, {5, 0, 3, 0}},
+			exhausted:  []int32{0, 0, 3},
+			eliminated: []int32{3, 1, -1},
+		},
+		{
+			name:       "every ballot exhausted",
+			options:    2,
+			ballots:    [][]int32{{}, {}},
+			winner:     -1,
+			tallies:    [][]int32{{0, 0}},
+			exhausted:  []int32{2},
+			eliminated: []int32{-1},
+		},
+		{
+			name:       "out of range preferences are skipped",
+			options:    2,
+			ballots:    [][]int32{{5, 1}, {-1, 1}, {0}, {7}},
+			winner:     1,
+			tallies:    [][]int32{{1, 2}},
+			exhausted:  []int32{1},
+			eliminated: []int32{-1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := instantRunoff(tt.options, tt.ballots)
+
+			if res.Ballots != int32(len(tt.ballots)) {
+				t.Errorf("ballots = %d, want %d", res.Ballots, len(tt.ballots))
+			}
+			winner := int32(-1)
+			if res.Winner != nil {
+				winner = *res.Winner
+			}
+			if winner != tt.winner {
+				t.Errorf("winner = %d, want %d", winner, tt.winner)
+			}
+
+			tallies := [][]int32{}
+			exhausted := []int32{}
+			eliminated := []int32{}
+			for i, r := range res.Rounds {
+				if r.Round != int32(i+1) {
+					t.Errorf("round %d numbered %d", i+1, r.Round)
+				}
+				tallies = append(tallies, r.Tallies)
+				exhausted = append(exhausted, r.Exhausted)
+				e := int32(-1)
+				if r.Eliminated != nil {
+					e = *r.Eliminated
+				}
+				eliminated = append(eliminated, e)
+			}
+			if !reflect.DeepEqual(tallies, tt.tallies) {
+				t.Errorf("tallies = %v, want %v", tallies, tt.tallies)
+			}
+			if !reflect.DeepEqual(exhausted, tt.exhausted) {
+				t.Errorf("exhausted = %v, want %v", exhausted, tt.exhausted)
+			}
+			if !reflect.DeepEqual(eliminated, tt.eliminated) {
+				t.Errorf("eliminated = %v, want %v", eliminated, tt.eliminated)
+			}
+		})
+	}
+}
+
+func TestInstantRunoffTransfers(t *testing.T) {
+	res := instantRunoff(3, [][]int32{{0}, {0}, {1, 0}, {1, 2}, {2}, {2}, {2, 1}})
+
+	// Option 1 has the fewest first preferences, its two ballots move on to options 0 and 2.
+	if len(res.Rounds) < 2 || res.Rounds[0].Eliminated == nil || *res.Rounds[0].Eliminated != 1 {
+		t.Fatalf("rounds = %+v, want option 1 eliminated first", res.Rounds)
+	}
+	transfers := map[int32]int32{}
+	for _, tr := range res.Rounds[0].Transfers {
+		if tr.To == nil {
+			t.Errorf("unexpected exhausted transfer of %d", tr.Votes)
+			continue
+		}
+		transfers[*tr.To] = tr.Votes
+	}
+	if !reflect.DeepEqual(transfers, map[int32]int32{0: 1, 2: 1}) {
+		t.Errorf("transfers = %v, want one ballot to each of 0 and 2", transfers)
+	}
+	if res.Winner == nil || *res.Winner != 2 {
+		t.Errorf("winner = %v, want 2", res.Winner)
+	}
+}
@@ -0,0 +1,162 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/graph-gophers/graphql-go/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// Rate limits are sliding windows kept in redis sorted sets scored by the unix time in milliseconds of each request.
+// Every operation has a budget per scope, such as the client ip or the poll, configured as rate_limits.<operation>.<scope>
+// with a limit of requests per window in seconds. A limit of 0 disables a budget.
+type rateBudget struct {
+	Limit  int
+	Window time.Duration
+}
+
+var defaultRateLimits = map[string]map[string]rateBudget{
+	"vote": {
+		"ip":   {60, time.Minute},
+		"poll": {1000, time.Second},
+	},
+	"new": {
+		"ip": {20, time.Hour},
+	},
+	"new_draft": {
+		"ip": {20, time.Hour},
+	},
+	"watch": {
+		"ip":   {60, time.Minute},
+		"poll": {0, time.Second},
+	},
+	"voter_token": {
+		"ip": {20, time.Hour},
+	},
+	"ballot_log": {
+		"ip": {60, time.Minute},
+	},
+}
+
+func rateLimit(op string, scope string) rateBudget {
+	b := defaultRateLimits[op][scope]
+	key := fmt.Sprintf("rate_limits.%s.%s", op, scope)
+	if configure.Config.IsSet(key + ".limit") {
+		b.Limit = configure.Config.GetInt(key + ".limit")
+	}
+	if configure.Config.IsSet(key + ".window") {
+		b.Window = time.Duration(configure.Config.GetInt(key+".window")) * time.Second
+	}
+	return b
+}
+
+// rateLimitScript counts a request against every budget only if none of them are used up,
+// otherwise it returns the milliseconds until the fullest budget has room again.
+//
+// KEYS: one sorted set per budget
+// ARGV: unique member for the request, then the limit and window in ms of each budget.
+var rateLimitScript = redis.NewScript(`
+redis.replicate_commands()
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[i * 2])
+	local window = tonumber(ARGV[i * 2 + 1])
+	redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+	if redis.call("ZCARD", key) >= limit then
+		local oldest = redis.call("ZRANGE", key, 0, 0, "WITHSCORES")
+		wait = math.max(wait, tonumber(oldest[2]) + window - now)
+	end
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	redis.call("ZADD", key, now, ARGV[1])
+	redis.call("PEXPIRE", key, ARGV[i * 2 + 1])
+end
+return 0
+`)
+
+// rateLimited counts a request against the budgets of an operation, returning how long to wait if a budget is used up.
+// scopes maps each scope to who the request is counted for, scopes without a value are not limited.
+// Requests are let through if redis fails, so an outage of the limiter does not take down voting.
+func rateLimited(op string, scopes map[string]string) time.Duration {
+	keys := []string{}
+	args := []interface{}{""}
+	for scope, who := range scopes {
+		b := rateLimit(op, scope)
+		if who == "" || b.Limit <= 0 || b.Window <= 0 {
+			continue
+		}
+		keys = append(keys, fmt.Sprintf("ratelimit:%s:%s:%s", op, scope, who))
+		args = append(args, b.Limit, b.Window.Milliseconds())
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+
+	member, err := utils.GenerateRandomString(12)
+	if err != nil {
+		log.Errorf("random, err=%v", err)
+		return 0
+	}
+	args[0] = member
+
+	wait, err := rateLimitScript.Run(redis.Ctx, redis.Client, keys, args...).Int64()
+	if err != nil {
+		log.Errorf("redis, err=%v", err)
+		return 0
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+// requestIP returns the client ip of a request.
+func requestIP(ctx context.Context) string {
+	if ip := ctx.Value(utils.Key("ip")); ip != nil {
+		return ip.(string)
+	}
+	return ""
+}
+
+// rateLimitedError is returned by operations without a result state to report the rate limit on.
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+func (e rateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %d seconds", e.retryAfterSeconds())
+}
+
+func (e rateLimitedError) retryAfterSeconds() int64 {
+	return int64(math.Ceil(e.retryAfter.Seconds()))
+}
+
+func (e rateLimitedError) Extensions() map[string]interface{} {
+	return map[string]interface{}{
+		"code":        "RATE_LIMITED",
+		"retry_after": e.retryAfterSeconds(),
+	}
+}
+
+// retryAfter is the retry_after of a RATE_LIMITED result state, in seconds.
+func retryAfter(wait time.Duration) *int32 {
+	s := int32(rateLimitedError{wait}.retryAfterSeconds())
+	return &s
+}
+
+// queryError carries the extensions of the error through subscriptions, which do not read them from resolver errors.
+func (e rateLimitedError) queryError() *errors.QueryError {
+	return &errors.QueryError{
+		Message:       e.Error(),
+		Extensions:    e.Extensions(),
+		ResolverError: e,
+	}
+}
@@ -3,7 +3,6 @@ package resolvers
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"sync"
 	"time"
 
@@ -26,10 +25,43 @@ var (
 
 type PollVote []int32
 
+// PollClosed is the payload of the events:poll:closed:<id> channel.
+type PollClosed struct {
+	// Reason is either "closed" when the owner closed the poll or "expired".
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// PollReopened is the payload of the events:poll:reopened:<id> channel.
+type PollReopened struct {
+	At     time.Time  `json:"at"`
+	Expiry *time.Time `json:"expiry"`
+}
+
+// PollEdited is the payload of the events:poll:edited:<id> channel, it carries the poll as it is after the edit.
+type PollEdited struct {
+	At      time.Time  `json:"at"`
+	Title   string     `json:"title"`
+	Options []string   `json:"options"`
+	Expiry  *time.Time `json:"expiry"`
+}
+
+// PollReleased is the payload of the events:poll:released:<id> channel, it carries the public vote hashes after the release.
+type PollReleased struct {
+	At     time.Time         `json:"at"`
+	Votes  map[string]string `json:"votes"`
+	Scores map[string]string `json:"scores"`
+}
+
+// PollDeleted is the payload of the events:poll:deleted:<id> channel.
+type PollDeleted struct {
+	At time.Time `json:"at"`
+}
+
 func New() *RootResolver {
 	rr := &RootResolver{
 		mtx:    &sync.Mutex{},
-		subs:   make(map[string][]chan PollVote),
+		subs:   make(map[string][]chan *redis.Message),
 		pubsub: redis.Client.Subscribe(redis.Ctx),
 	}
 
@@ -37,25 +69,19 @@ func New() *RootResolver {
 		ch := rr.pubsub.Channel()
 		for {
 			msg := <-ch
-			vote := PollVote{}
-			err := json.UnmarshalFromString(msg.Payload, &vote)
-			if err != nil {
-				log.Errorf("redis, err=%v", err)
-				continue
-			}
 			wg := sync.WaitGroup{}
 			rr.mtx.Lock()
 			if v, ok := rr.subs[msg.Channel]; ok {
 				wg.Add(len(v))
 				for _, c := range v {
-					go func(c chan PollVote) {
+					go func(c chan *redis.Message) {
 						defer func() {
 							if err := recover(); err != nil {
 								log.Errorf("recovered, err=%v", err)
 							}
 						}()
 						wg.Done()
-						c <- vote
+						c <- msg
 					}(c)
 				}
 			}
@@ -64,16 +90,19 @@ func New() *RootResolver {
 		}
 	}()
 
+	go runLifecycle()
+	go runPresence()
+
 	return rr
 }
 
 type RootResolver struct {
 	mtx    *sync.Mutex
-	subs   map[string][]chan PollVote
+	subs   map[string][]chan *redis.Message
 	pubsub *redis.PubSub
 }
 
-func filterSlice(s []chan PollVote, r chan PollVote) []chan PollVote {
+func filterSlice(s []chan *redis.Message, r chan *redis.Message) []chan *redis.Message {
 	for i, v := range s {
 		if v == r {
 			return append(s[:i], s[i+1:]...)
@@ -82,19 +111,19 @@ func filterSlice(s []chan PollVote, r chan PollVote) []chan PollVote {
 	return s
 }
 
-func (r *RootResolver) subscribe(event string, ch chan PollVote) error {
+func (r *RootResolver) subscribe(event string, ch chan *redis.Message) error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 	if v, ok := r.subs[event]; ok {
 		r.subs[event] = append(v, ch)
 	} else {
-		r.subs[event] = []chan PollVote{ch}
+		r.subs[event] = []chan *redis.Message{ch}
 		return r.pubsub.Subscribe(redis.Ctx, event)
 	}
 	return nil
 }
 
-func (r *RootResolver) unsubscribe(event string, ch chan PollVote) error {
+func (r *RootResolver) unsubscribe(event string, ch chan *redis.Message) error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 	new := filterSlice(r.subs[event], ch)
@@ -133,25 +162,28 @@ func generateSelectedFieldMap(ctx context.Context) *selectedField {
 	}
 }
 
+// fetchPoll reads a poll along with the selected live fields. The tally and the seq of the last event are read in one transaction,
+// so the seq tells exactly which events the tally already counts.
 func fetchPoll(id primitive.ObjectID, field *selectedField) (*mongo.Poll, error) {
-	pipe := redis.Client.Pipeline()
+	pipe := redis.Client.TxPipeline()
 
 	redisKey := fmt.Sprintf("cached:polls:%s", id.Hex())
 
-	fetchVotes := false
-
-	if field != nil {
-		if v, ok := field.children["options"]; ok {
-			if _, ok := v.children["votes"]; ok {
-				fetchVotes = true
-			}
-		}
-	}
+	fetchVotes := wantsTally(field)
 
 	valCmd := pipe.Get(redis.Ctx, redisKey)
-	var votesCmd *redis.StringStringMapCmd
+	var votesCmd, scoresCmd *redis.StringStringMapCmd
 	if fetchVotes {
 		votesCmd = pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", id.Hex()))
+		scoresCmd = pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:scores", id.Hex()))
+	}
+	var watchersCmd *redis.StringCmd
+	if wantsWatchers(field) {
+		watchersCmd = pipe.HGet(redis.Ctx, fmt.Sprintf("poll:watchers:%s", id.Hex()), "total")
+	}
+	var seqCmd *redis.StringCmd
+	if fetchVotes || wantsSeq(field) {
+		seqCmd = pipe.Get(redis.Ctx, eventSeqKey(id))
 	}
 	_, err := pipe.Exec(redis.Ctx)
 	if err != nil && err != redis.ErrNil {
@@ -189,14 +221,7 @@ func fetchPoll(id primitive.ObjectID, field *selectedField) (*mongo.Poll, error)
 			return nil, errInternalServer
 		}
 
-		pollStr, err := json.MarshalToString(poll)
-		if err == nil {
-			if err = redis.Client.Set(redis.Ctx, redisKey, pollStr, time.Hour*6).Err(); err != nil {
-				log.Errorf("redis, err=%v", err)
-			}
-		} else {
-			log.Errorf("redis, err=%v", err)
-		}
+		cachePoll(poll)
 	} else if err = json.UnmarshalFromString(val, poll); err != nil {
 		log.Errorf("json, err=%v", err)
 		return nil, errInternalServer
@@ -204,39 +229,93 @@ func fetchPoll(id primitive.ObjectID, field *selectedField) (*mongo.Poll, error)
 
 	if field != nil {
 		if _, ok := field.children["options"]; ok {
-			var votes map[string]string
+			var votes, scores map[string]string
 			if fetchVotes {
 				votes, err = votesCmd.Result()
-				if err != nil {
-					if err == redis.ErrNil {
-						votes = nil
-					} else {
-						log.Errorf("redis, err=%v", err)
-						return nil, errInternalServer
-					}
+				if err == nil {
+					scores, err = scoresCmd.Result()
 				}
-			}
-			options := make([]mongo.PollOption, len(poll.OptionsRaw))
-
-			for i, v := range poll.OptionsRaw {
-				var voteCount int32
-				if votes != nil {
-					if count, ok := votes[fmt.Sprint(i)]; ok {
-						tVal, err := strconv.ParseInt(count, 10, 32)
-						if err != nil {
-							return nil, err
-						}
-						voteCount = int32(tVal)
-					}
-				}
-				options[i] = mongo.PollOption{
-					Title: v,
-					Votes: voteCount,
+				if err != nil && err != redis.ErrNil {
+					log.Errorf("redis, err=%v", err)
+					return nil, errInternalServer
 				}
 			}
+			options, err := buildOptions(poll, votes, scores)
+			if err != nil {
+				return nil, err
+			}
 			poll.Options = &options
 		}
 	}
 
+	if watchersCmd != nil {
+		watchers := parseWatchers(watchersCmd.Val())
+		poll.Watchers = &watchers
+	}
+	if seqCmd != nil {
+		seq := pollSeq(poll, seqCmd.Val())
+		poll.Seq = &seq
+	}
+
 	return poll, nil
 }
+
+func cachePoll(poll *mongo.Poll) {
+	pollStr, err := json.MarshalToString(poll)
+	if err == nil {
+		if err = redis.Client.Set(redis.Ctx, fmt.Sprintf("cached:polls:%s", poll.ID.Hex()), pollStr, time.Hour*6).Err(); err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+	} else {
+		log.Errorf("redis, err=%v", err)
+	}
+}
+
+func fetchDraft(id primitive.ObjectID) (*mongo.Draft, error) {
+	redisKey := fmt.Sprintf("cached:drafts:%s", id.Hex())
+
+	val, err := redis.Client.Get(redis.Ctx, redisKey).Result()
+	if err != nil && err != redis.ErrNil {
+		log.Errorf("redis, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	if val == "dead" {
+		return nil, nil
+	}
+
+	draft := &mongo.Draft{}
+	if err == redis.ErrNil {
+		result := mongo.Database.Collection("drafts").FindOne(mongo.Ctx, bson.M{
+			"_id": id,
+		})
+		err = result.Err()
+		if err == mongo.ErrNoDocuments {
+			if err = redis.Client.Set(redis.Ctx, redisKey, "dead", time.Hour*6).Err(); err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+			return nil, nil
+		}
+		if err == nil {
+			err = result.Decode(draft)
+		}
+		if err != nil {
+			log.Errorf("mongo, err=%v", err)
+			return nil, errInternalServer
+		}
+
+		draftStr, err := json.MarshalToString(draft)
+		if err == nil {
+			if err = redis.Client.Set(redis.Ctx, redisKey, draftStr, time.Hour*6).Err(); err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+		} else {
+			log.Errorf("redis, err=%v", err)
+		}
+	} else if err = json.UnmarshalFromString(val, draft); err != nil {
+		log.Errorf("json, err=%v", err)
+		return nil, errInternalServer
+	}
+
+	return draft, nil
+}
@@ -0,0 +1,256 @@
+package resolvers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Every event of a poll is numbered from poll:events:<id>:seq, kept in the poll:events:<id> stream under the id <seq>-0
+// for replays, and published as {"seq":<seq>,"data":<payload>}. The stream keeps roughly the last event_retention events.
+// Both keys of a closed poll expire event_ttl after its last event, the seq is kept with the poll in mongo so it carries on from there.
+//
+// luaPublishEvent defines publish_event(seq key, stream key, channel, kind, payload, retention, floor, ttl) for scripts that publish events,
+// where floor is the seq to carry on from if the counter expired and ttl the ms until the keys expire, 0 to keep them.
+const luaPublishEvent = `
+local function publish_event(seq_key, stream_key, channel, kind, payload, retention, floor, ttl)
+	if tonumber(floor) > 0 then
+		redis.call("SET", seq_key, floor, "NX")
+	end
+	local seq = redis.call("INCR", seq_key)
+	redis.call("XADD", stream_key, "MAXLEN", "~", retention, seq .. "-0", "kind", kind, "payload", payload)
+	if tonumber(ttl) > 0 then
+		redis.call("PEXPIRE", seq_key, ttl)
+		redis.call("PEXPIRE", stream_key, ttl)
+	else
+		redis.call("PERSIST", seq_key)
+		redis.call("PERSIST", stream_key)
+	end
+	redis.call("PUBLISH", channel, '{"seq":' .. seq .. ',"data":' .. payload .. '}')
+	return seq
+end
+`
+
+// eventScript publishes an event of a poll.
+//
+// KEYS: seq counter, event stream
+// ARGV: event channel, kind, payload, retention, floor, ttl
+var eventScript = redis.NewScript(luaPublishEvent + `
+return publish_event(KEYS[1], KEYS[2], ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6])
+`)
+
+func eventRetention() int {
+	if n := configure.Config.GetInt("event_retention"); n > 0 {
+		return n
+	}
+	return 1000
+}
+
+func eventTTL() time.Duration {
+	if n := configure.Config.GetInt("event_ttl"); n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 7 * 24 * time.Hour
+}
+
+// eventExpiry returns the ms until the event keys of a poll expire after its next event, 0 while the poll is open.
+func eventExpiry(closed bool) int64 {
+	if !closed {
+		return 0
+	}
+	return eventTTL().Milliseconds()
+}
+
+// keepEventSeq stores the seq of an event published on a closed poll with the poll, for when its event keys expired.
+func keepEventSeq(id primitive.ObjectID, seq int64) {
+	if _, err := mongo.Database.Collection("polls").UpdateOne(mongo.Ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$max": bson.M{"event_seq": seq},
+	}); err != nil {
+		log.Errorf("mongo, err=%v", err)
+		return
+	}
+	invalidatePoll(id)
+}
+
+func eventSeqKey(id primitive.ObjectID) string {
+	return fmt.Sprintf("poll:events:%s:seq", id.Hex())
+}
+
+func eventStreamKey(id primitive.ObjectID) string {
+	return fmt.Sprintf("poll:events:%s", id.Hex())
+}
+
+// pollEventMessage is the envelope events are published in.
+type pollEventMessage struct {
+	Seq  int64               `json:"seq"`
+	Data jsoniter.RawMessage `json:"data"`
+}
+
+// storedEvent is an event read back from the stream of a poll.
+type storedEvent struct {
+	Seq     int64
+	Kind    string
+	Payload string
+}
+
+// parseEventMessage reads an event published on one of the event channels of a poll.
+func parseEventMessage(kind string, payload string) (storedEvent, error) {
+	event := pollEventMessage{}
+	if err := json.UnmarshalFromString(payload, &event); err != nil {
+		return storedEvent{}, err
+	}
+	return storedEvent{event.Seq, kind, string(event.Data)}, nil
+}
+
+// eventCursor tracks which events of a poll a stream has applied.
+// Messages can arrive out of order, so an event that skips ahead brings along the events it skipped over, read back from the stream of the poll.
+// Events that could not be read back are applied whenever they arrive, only events that were applied are dropped.
+type eventCursor struct {
+	id      primitive.ObjectID
+	last    int64
+	missing map[int64]bool
+	// fetch reads skipped events back, it is fetchEventsSince outside of tests.
+	fetch func(id primitive.ObjectID, since int64, until int64) ([]storedEvent, bool, error)
+}
+
+func newEventCursor(id primitive.ObjectID, last int64) *eventCursor {
+	return &eventCursor{id, last, map[int64]bool{}, fetchEventsSince}
+}
+
+// next returns the events to apply, oldest first, now that the given event arrived.
+func (c *eventCursor) next(event storedEvent) []storedEvent {
+	if event.Seq <= c.last {
+		if c.missing[event.Seq] {
+			delete(c.missing, event.Seq)
+			return []storedEvent{event}
+		}
+		return nil
+	}
+
+	events := []storedEvent{}
+	if event.Seq > c.last+1 {
+		missed, _, err := c.fetch(c.id, c.last, event.Seq)
+		if err != nil {
+			log.Errorf("redis, err=%v", err)
+		}
+		found := map[int64]bool{}
+		for _, e := range missed {
+			if e.Seq > c.last && e.Seq < event.Seq && !found[e.Seq] {
+				found[e.Seq] = true
+				events = append(events, e)
+			}
+		}
+		for seq := c.last + 1; seq < event.Seq; seq++ {
+			if !found[seq] {
+				c.missing[seq] = true
+			}
+		}
+	}
+	c.last = event.Seq
+
+	return append(events, event)
+}
+
+// applyPollEvent applies an event to a watched poll, moving its seq forward.
+// It returns the event's kind, or an empty string when the event does not change what a watcher sees.
+func applyPollEvent(poll *mongo.Poll, event storedEvent) string {
+	if poll.Seq == nil || event.Seq > *poll.Seq {
+		seq := event.Seq
+		poll.Seq = &seq
+	}
+	switch event.Kind {
+	case "vote":
+		vote := PollVote{}
+		if err := json.UnmarshalFromString(event.Payload, &vote); err != nil {
+			log.Errorf("json, err=%v", err)
+			return ""
+		}
+		applyVote(poll, *poll.Options, vote)
+	case "closed":
+		closed := PollClosed{}
+		if err := json.UnmarshalFromString(event.Payload, &closed); err != nil {
+			log.Errorf("json, err=%v", err)
+			return ""
+		}
+		poll.Closed = true
+		poll.ClosedAt = &closed.At
+	case "released":
+		released := PollReleased{}
+		if err := json.UnmarshalFromString(event.Payload, &released); err != nil {
+			log.Errorf("json, err=%v", err)
+			return ""
+		}
+		options, err := buildOptions(poll, released.Votes, released.Scores)
+		if err != nil {
+			log.Errorf("tally, err=%v", err)
+			return ""
+		}
+		poll.Options = &options
+	default:
+		return ""
+	}
+	return event.Kind
+}
+
+// fetchEventsSince reads the retained events of a poll after since, up to and including until or every one after since if until is negative.
+// It reports false if events in that range were already trimmed from the stream.
+func fetchEventsSince(id primitive.ObjectID, since int64, until int64) ([]storedEvent, bool, error) {
+	end := "+"
+	if until >= 0 {
+		if since >= until {
+			return nil, since == until, nil
+		}
+		end = fmt.Sprintf("%d-0", until)
+	}
+
+	msgs, err := redis.Client.XRange(redis.Ctx, eventStreamKey(id), fmt.Sprintf("%d-0", since+1), end).Result()
+	if err != nil && err != redis.ErrNil {
+		return nil, false, err
+	}
+
+	events := make([]storedEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(msg.ID, "-0"), 10, 64)
+		if err != nil {
+			continue
+		}
+		kind, _ := msg.Values["kind"].(string)
+		payload, _ := msg.Values["payload"].(string)
+		events = append(events, storedEvent{seq, kind, payload})
+	}
+
+	return events, until < 0 || int64(len(events)) == until-since, nil
+}
+
+// parseSeq reads the seq counter of a poll, polls without events have none.
+func parseSeq(seq string) int64 {
+	n, _ := strconv.ParseInt(seq, 10, 64)
+	return n
+}
+
+// pollSeq reads the seq counter of a poll, falling back to the seq kept with the poll once its event keys expired.
+func pollSeq(poll *mongo.Poll, seq string) int64 {
+	if n := parseSeq(seq); n > 0 {
+		return n
+	}
+	return poll.EventSeq
+}
+
+func wantsSeq(field *selectedField) bool {
+	if field == nil {
+		return false
+	}
+	_, ok := field.children["seq"]
+	return ok
+}
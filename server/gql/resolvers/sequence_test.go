@@ -0,0 +1,126 @@
+package resolvers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeStream stands in for the event stream of a poll, holding the events that can still be read back.
+type fakeStream struct {
+	events []storedEvent
+	err    error
+	calls  [][2]int64
+}
+
+func (s *fakeStream) fetch(id primitive.ObjectID, since int64, until int64) ([]storedEvent, bool, error) {
+	s.calls = append(s.calls, [2]int64{since, until})
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	events := []storedEvent{}
+	for _, e := range s.events {
+		if e.Seq > since && e.Seq <= until {
+			events = append(events, e)
+		}
+	}
+	return events, int64(len(events)) == until-since, nil
+}
+
+func streamEvents(seqs ...int64) []storedEvent {
+	events := make([]storedEvent, len(seqs))
+	for i, seq := range seqs {
+		events[i] = storedEvent{seq, "vote", "stream"}
+	}
+	return events
+}
+
+func TestEventCursor(t *testing.T) {
+	// Each step delivers the event with seq arrive and expects the seqs of the events to apply, with the payload of events read back from the stream.
+	type step struct {
+		arrive int64
+		apply  []int64
+	}
+	tests := []struct {
+		name   string
+		last   int64
+		stream *fakeStream
+		steps  []step
+		calls  [][2]int64
+	}{
+		{
+			name:   "in order",
+			stream: &fakeStream{},
+			steps:  []step{{1, []int64{1}}, {2, []int64{2}}, {3, []int64{3}}},
+			calls:  [][2]int64{},
+		},
+		{
+			name:   "duplicates and old events are dropped",
+			last:   5,
+			stream: &fakeStream{},
+			steps:  []step{{4, nil}, {5, nil}, {6, []int64{6}}, {6, nil}},
+			calls:  [][2]int64{},
+		},
+		{
+			name:   "reordered events are backfilled once",
+			stream: &fakeStream{events: streamEvents(1, 2, 3)},
+			steps:  []step{{3, []int64{1, 2, 3}}, {1, nil}, {2, nil}, {4, []int64{4}}},
+			calls:  [][2]int64{{0, 3}},
+		},
+		{
+			name:   "gap after the start",
+			last:   10,
+			stream: &fakeStream{events: streamEvents(11, 12, 13, 14)},
+			steps:  []step{{11, []int64{11}}, {14, []int64{12, 13, 14}}, {13, nil}},
+			calls:  [][2]int64{{11, 14}},
+		},
+		{
+			name:   "gap that cannot be read back",
+			stream: &fakeStream{err: errors.New("redis down")},
+			steps:  []step{{3, []int64{3}}, {2, []int64{2}}, {2, nil}, {1, []int64{1}}, {1, nil}},
+			calls:  [][2]int64{{0, 3}},
+		},
+		{
+			name:   "gap partly trimmed from the stream",
+			stream: &fakeStream{events: streamEvents(3, 4)},
+			steps:  []step{{4, []int64{3, 4}}, {3, nil}, {2, []int64{2}}, {1, []int64{1}}},
+			calls:  [][2]int64{{0, 4}},
+		},
+	}
+
+	id := primitive.NewObjectID()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newEventCursor(id, tt.last)
+			c.fetch = tt.stream.fetch
+
+			for _, s := range tt.steps {
+				events := c.next(storedEvent{s.arrive, "vote", "live"})
+				var seqs []int64
+				for _, e := range events {
+					seqs = append(seqs, e.Seq)
+					want := "stream"
+					if e.Seq == s.arrive {
+						want = "live"
+					}
+					if e.Payload != want {
+						t.Errorf("arrive %d: event %d has payload %q, want %q", s.arrive, e.Seq, e.Payload, want)
+					}
+				}
+				if !reflect.DeepEqual(seqs, s.apply) {
+					t.Errorf("arrive %d: apply %v, want %v", s.arrive, seqs, s.apply)
+				}
+			}
+
+			calls := tt.stream.calls
+			if calls == nil {
+				calls = [][2]int64{}
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("fetch calls = %v, want %v", calls, tt.calls)
+			}
+		})
+	}
+}
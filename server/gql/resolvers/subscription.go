@@ -3,8 +3,12 @@ package resolvers
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -12,14 +16,40 @@ var (
 	errPollNotFound = fmt.Errorf("poll not found")
 )
 
-func (r *RootResolver) Watch(ctx context.Context, args struct{ ID string }) (<-chan *pollResolver, error) {
-	field := generateSelectedFieldMap(ctx)
+type watchArgs struct {
+	ID         string
+	ThrottleMs *int32
+	SinceSeq   *int32
+}
+
+func (r *RootResolver) Watch(ctx context.Context, args watchArgs) (<-chan *pollResolver, error) {
+	args.SinceSeq = sinceSeq(ctx, args.SinceSeq)
+	return r.watch(ctx, args, generateSelectedFieldMap(ctx))
+}
+
+// sinceSeq returns since_seq, or when it is left out the seq a server sent events stream picks up from after a reconnect.
+func sinceSeq(ctx context.Context, arg *int32) *int32 {
+	if arg != nil {
+		return arg
+	}
+	if seq, ok := ctx.Value(utils.Key("since_seq")).(int32); ok {
+		return &seq
+	}
+	return nil
+}
 
+// watch streams a poll, first as it is and then whenever it changes. Every frame is a copy of the poll,
+// so the frames already sent are not changed by the votes that come after them.
+func (r *RootResolver) watch(ctx context.Context, args watchArgs, field *selectedField) (<-chan *pollResolver, error) {
 	id, err := primitive.ObjectIDFromHex(args.ID)
 	if err != nil {
 		return nil, errPollNotFound
 	}
 
+	if wait := rateLimited("watch", map[string]string{"ip": requestIP(ctx), "poll": id.Hex()}); wait > 0 {
+		return nil, rateLimitedError{wait}.queryError()
+	}
+
 	poll, err := fetchPoll(id, field)
 	if err != nil {
 		return nil, err
@@ -28,50 +58,193 @@ func (r *RootResolver) Watch(ctx context.Context, args struct{ ID string }) (<-c
 		return nil, errPollNotFound
 	}
 
-	resolver := &pollResolver{}
 	rChan := make(chan *pollResolver, 1)
 
-	fetchVotes := false
-	if v, ok := field.children["options"]; ok {
-		if _, ok := v.children["votes"]; ok {
-			fetchVotes = true
+	fetchVotes := wantsTally(field)
+	fetchWatchers := wantsWatchers(field)
+
+	// A client that reconnects with the seq of the last frame it got is sent a frame for every vote it missed, as long as the
+	// stream still has them all and they were all votes. Otherwise, or without since_seq, the stream starts from the poll as it is.
+	var replay []storedEvent
+	if args.SinceSeq != nil && fetchVotes {
+		missed, complete, err := fetchEventsSince(poll.ID, int64(*args.SinceSeq), *poll.Seq)
+		if err != nil {
+			log.Errorf("redis, err=%v", err)
+			return nil, errInternalServer
+		}
+		if complete && len(missed) > 0 {
+			replay = missed
+			for _, e := range missed {
+				if e.Kind != "vote" {
+					replay = nil
+					break
+				}
+			}
 		}
 	}
 
-	resolver.poll = poll
+	// The first frame is queued before any update can be, rChan only buffers one. Replayed frames are sent once the stream is live.
+	if replay == nil {
+		rChan <- &pollResolver{clonePoll(poll), nil}
+	}
 
-	if fetchVotes {
-		vote := make(chan PollVote, 100)
+	// Scheduled polls are sent again when they open, so clients can switch to live voting.
+	var opened <-chan time.Time
+	var timer *time.Timer
+	if pollStatus(poll) == pollStatusScheduled {
+		timer = time.NewTimer(time.Until(*poll.OpensAt))
+		opened = timer.C
+	}
 
-		err = r.subscribe(fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex()), vote)
+	if !fetchVotes && !fetchWatchers && opened == nil {
+		close(rChan)
+		return rChan, nil
+	}
+
+	events := make(chan *redis.Message, 100)
+	voteChannel := fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex())
+	closedChannel := fmt.Sprintf("events:poll:closed:%s", poll.ID.Hex())
+	releasedChannel := fmt.Sprintf("events:poll:released:%s", poll.ID.Hex())
+	watchersChannel := fmt.Sprintf("events:poll:watchers:%s", poll.ID.Hex())
+	kinds := map[string]string{voteChannel: "vote", closedChannel: "closed", releasedChannel: "released"}
+	channels := []string{}
+	if fetchVotes {
+		channels = append(channels, voteChannel, closedChannel, releasedChannel)
+	}
+	if fetchWatchers {
+		channels = append(channels, watchersChannel)
+	}
+	for _, c := range channels {
+		err = r.subscribe(c, events)
 		if err != nil {
 			log.Errorf("redis, err=%v", err)
 			return nil, errInternalServer
 		}
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					err = r.unsubscribe(fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex()), vote)
-					if err != nil {
-						log.Errorf("redis, err=%v", err)
-					}
-					return
-				case v := <-vote:
-					opts := *poll.Options
-					for _, s := range v {
-						opts[s].Votes++
-					}
-					poll.Options = &opts
-					rChan <- resolver
+	}
+
+	throttle := watchThrottle(args.ThrottleMs)
+	atomic.AddInt64(&activeWatches, 1)
+	presence.add(poll.ID, 1)
+
+	go func() {
+		defer atomic.AddInt64(&activeWatches, -1)
+		defer presence.add(poll.ID, -1)
+		defer func() {
+			for _, c := range channels {
+				if err := r.unsubscribe(c, events); err != nil {
+					log.Errorf("redis, err=%v", err)
 				}
 			}
 		}()
-	}
-	defer func() {
-		rChan <- resolver
-		if !fetchVotes {
-			close(rChan)
+		if timer != nil {
+			defer timer.Stop()
+		}
+
+		// Votes are applied to the poll as they arrive and sent together once the interval since the last update has passed.
+		var flush <-chan time.Time
+		var flushTimer *time.Timer
+		defer func() {
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+		}()
+		var lastSent time.Time
+		pending := false
+		send := func() {
+			select {
+			case rChan <- &pollResolver{clonePoll(poll), nil}:
+			case <-ctx.Done():
+			}
+			lastSent = time.Now()
+			pending = false
+		}
+		queue := func() {
+			pending = true
+			if flush == nil {
+				if wait := watchInterval(throttle) - time.Since(lastSent); wait > 0 {
+					flushTimer = time.NewTimer(wait)
+					flush = flushTimer.C
+				} else {
+					send()
+				}
+			}
+		}
+
+		if replay != nil {
+			// The poll is walked back to since_seq by taking the missed votes out again, then every vote is sent as its own frame.
+			current := poll
+			poll = clonePoll(current)
+			for i := len(replay) - 1; i >= 0; i-- {
+				vote := PollVote{}
+				if err := json.UnmarshalFromString(replay[i].Payload, &vote); err == nil {
+					unapplyVote(poll, *poll.Options, vote)
+				}
+			}
+			seq := int64(*args.SinceSeq)
+			poll.Seq = &seq
+			for _, e := range replay {
+				applyPollEvent(poll, e)
+				send()
+			}
+			poll = current
+		}
+
+		var cursor *eventCursor
+		handle := func(event storedEvent) {
+			for _, e := range cursor.next(event) {
+				switch applyPollEvent(poll, e) {
+				case "vote", "released":
+					queue()
+				case "closed":
+					// Closing is sent straight away, along with any votes still waiting on the throttle.
+					send()
+				}
+			}
+		}
+
+		// Events published between reading the poll and subscribing only reached the stream.
+		if fetchVotes {
+			cursor = newEventCursor(poll.ID, *poll.Seq)
+			missed, _, err := fetchEventsSince(poll.ID, *poll.Seq, -1)
+			if err != nil {
+				log.Errorf("redis, err=%v", err)
+			}
+			for _, e := range missed {
+				handle(e)
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-opened:
+				opened = nil
+				send()
+				if !fetchVotes && !fetchWatchers {
+					close(rChan)
+					return
+				}
+			case <-flush:
+				flush = nil
+				if pending {
+					send()
+				}
+			case msg := <-events:
+				if msg.Channel == watchersChannel {
+					watchers := parseWatchers(msg.Payload)
+					poll.Watchers = &watchers
+					queue()
+					continue
+				}
+
+				event, err := parseEventMessage(kinds[msg.Channel], msg.Payload)
+				if err != nil {
+					log.Errorf("json, err=%v", err)
+					continue
+				}
+				handle(event)
+			}
 		}
 	}()
 	return rChan, nil
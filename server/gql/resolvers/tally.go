@@ -0,0 +1,370 @@
+package resolvers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Polls that received votes are added to tallyDirty and snapshotted into mongo by the lifecycle worker,
+// snapshotted polls are then added to tallyReconcile to have their tally checked against their ballots.
+const (
+	tallyDirty     = "tally:dirty"
+	tallyReconcile = "tally:reconcile"
+	tallyBatch     = 100
+)
+
+// Drift is a vote hash field where the tally in redis does not match the ballots in mongo.
+type Drift struct {
+	PollID  string
+	Key     string
+	Field   string
+	Redis   int64
+	Ballots int64
+}
+
+func snapshotInterval() time.Duration {
+	if s := configure.Config.GetInt("snapshot_interval"); s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func reconcileInterval() time.Duration {
+	if s := configure.Config.GetInt("reconcile_interval"); s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return time.Hour
+}
+
+// fetchTally reads the options and scores vote hashes of a poll.
+func fetchTally(id primitive.ObjectID) (map[string]string, map[string]string, error) {
+	pipe := redis.Client.Pipeline()
+	votesCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:options", id.Hex()))
+	scoresCmd := pipe.HGetAll(redis.Ctx, fmt.Sprintf("poll:votes:%s:scores", id.Hex()))
+	if _, err := pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		return nil, nil, err
+	}
+	return votesCmd.Val(), scoresCmd.Val(), nil
+}
+
+// snapshotDirtyPolls copies the tally of every poll that received votes since the last snapshot into mongo.
+func snapshotDirtyPolls() {
+	for {
+		ids, err := redis.Client.SPopN(redis.Ctx, tallyDirty, tallyBatch).Result()
+		if err != nil && err != redis.ErrNil {
+			log.Errorf("redis, err=%v", err)
+			return
+		}
+		for _, hex := range ids {
+			if err = snapshotPoll(hex); err != nil {
+				log.Errorf("snapshot, poll=%s err=%v", hex, err)
+				// Put the poll back so the next run retries it.
+				redis.Client.SAdd(redis.Ctx, tallyDirty, hex)
+			}
+		}
+		if len(ids) < tallyBatch {
+			return
+		}
+	}
+}
+
+func snapshotPoll(hex string) error {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return nil
+	}
+
+	poll, err := fetchPoll(id, nil)
+	if err != nil || poll == nil {
+		return err
+	}
+
+	votes, scores, err := fetchTally(id)
+	if err != nil {
+		return err
+	}
+	results, err := buildOptions(poll, votes, scores)
+	if err != nil {
+		return err
+	}
+
+	if _, err = mongo.Database.Collection("polls").UpdateOne(mongo.Ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$set": bson.M{
+			"results":    results,
+			"results_at": time.Now(),
+		},
+	}); err != nil {
+		return err
+	}
+	invalidatePoll(id)
+
+	return redis.Client.SAdd(redis.Ctx, tallyReconcile, hex).Err()
+}
+
+// reconcileSnapshottedPolls checks the tally of every poll snapshotted since the last run against its ballots, logging any drift.
+func reconcileSnapshottedPolls() {
+	for {
+		ids, err := redis.Client.SPopN(redis.Ctx, tallyReconcile, tallyBatch).Result()
+		if err != nil && err != redis.ErrNil {
+			log.Errorf("redis, err=%v", err)
+			return
+		}
+		for _, hex := range ids {
+			drift, err := ReconcileTally(hex)
+			if err != nil {
+				log.Errorf("reconcile, poll=%s err=%v", hex, err)
+				continue
+			}
+			for _, d := range drift {
+				log.Warnf("reconcile, drift poll=%s key=%s field=%s redis=%d ballots=%d", d.PollID, d.Key, d.Field, d.Redis, d.Ballots)
+			}
+		}
+		if len(ids) < tallyBatch {
+			return
+		}
+	}
+}
+
+// ballotCounts is the tally of a poll recomputed from its ballots, by vote hash key.
+type ballotCounts struct {
+	hashes map[string]map[string]int64
+	voters []string
+}
+
+// ballotTally recomputes the vote hashes of a poll from its ballots, along with the members of its dedup set.
+// Ballots still queued on the outbox are counted too, as the tally in redis already has them.
+// Quarantined ballots that were not released are counted in the quarantine hashes.
+func ballotTally(poll *mongo.Poll) (*ballotCounts, error) {
+	// The outbox is read before mongo, a ballot written in between is then seen twice and counted once instead of missed.
+	pending, err := pendingBallots(poll.ID)
+	if err != nil {
+		return nil, err
+	}
+	// A queued release entry releases every ballot before it, which includes every ballot already in mongo.
+	pendingRelease := -1
+	for i, entry := range pending {
+		if entry.Kind == ballotKindRelease {
+			pendingRelease = i
+		}
+	}
+
+	lastRelease, err := fetchLastRelease(poll.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := mongo.Database.Collection("pollanswers").Find(mongo.Ctx, bson.M{
+		"poll_id": poll.ID,
+		"kind":    bson.M{"$exists": false},
+	}, options.Find().SetProjection(bson.M{"answer": 1, "ip": 1, "voter": 1, "flags": 1, "seq": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(mongo.Ctx)
+
+	hex := poll.ID.Hex()
+	counts := &ballotCounts{
+		hashes: map[string]map[string]int64{},
+		voters: []string{},
+	}
+	for _, key := range voteHashKeys(hex) {
+		counts.hashes[key] = map[string]int64{}
+	}
+	ipDedupe := pollDedupMode(poll) == dedupIP
+	count := func(answer mongo.PollAnswer, quarantined bool) {
+		votes := counts.hashes[fmt.Sprintf("poll:votes:%s:options", hex)]
+		scores := counts.hashes[fmt.Sprintf("poll:votes:%s:scores", hex)]
+		if quarantined {
+			votes = counts.hashes[fmt.Sprintf("poll:votes:%s:quarantine:options", hex)]
+			scores = counts.hashes[fmt.Sprintf("poll:votes:%s:quarantine:scores", hex)]
+		}
+		o, s := tallyIncrements(poll, answer.Answer)
+		for f, v := range o {
+			votes[f] += v
+		}
+		for f, v := range s {
+			scores[f] += v
+		}
+		if len(answer.Voter) > 0 {
+			counts.voters = append(counts.voters, answer.Voter...)
+		} else if ipDedupe && answer.IP != "" {
+			// Ballots cast before dedup modes existed only carry their ip.
+			counts.voters = append(counts.voters, answer.IP)
+		}
+	}
+
+	written := map[primitive.ObjectID]bool{}
+	for cur.Next(mongo.Ctx) {
+		answer := mongo.PollAnswer{}
+		if err = cur.Decode(&answer); err != nil {
+			return nil, err
+		}
+		written[answer.ID] = true
+		count(answer, pendingRelease < 0 && quarantined(answer, lastRelease))
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, answer := range pending {
+		if answer.Kind != "" || written[answer.ID] {
+			continue
+		}
+		count(answer, len(answer.Flags) > 0 && i > pendingRelease)
+	}
+
+	return counts, nil
+}
+
+// voteHashKeys returns the keys of every vote hash of a poll.
+func voteHashKeys(hex string) []string {
+	return []string{
+		fmt.Sprintf("poll:votes:%s:options", hex),
+		fmt.Sprintf("poll:votes:%s:scores", hex),
+		fmt.Sprintf("poll:votes:%s:quarantine:options", hex),
+		fmt.Sprintf("poll:votes:%s:quarantine:scores", hex),
+	}
+}
+
+func fetchPollFromMongo(hex string) (*mongo.Poll, error) {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return nil, errMissingPoll
+	}
+
+	res := mongo.Database.Collection("polls").FindOne(mongo.Ctx, bson.M{
+		"_id": id,
+	})
+	poll := &mongo.Poll{}
+	err = res.Err()
+	if err == mongo.ErrNoDocuments {
+		return nil, errMissingPoll
+	}
+	if err == nil {
+		err = res.Decode(poll)
+	}
+	return poll, err
+}
+
+// ReconcileTally recomputes the tally of a poll from its ballots and returns every field where redis differs.
+func ReconcileTally(hex string) ([]Drift, error) {
+	poll, err := fetchPollFromMongo(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := ballotTally(poll)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := voteHashKeys(hex)
+	pipe := redis.Client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(redis.Ctx, key)
+	}
+	if _, err = pipe.Exec(redis.Ctx); err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	drift := []Drift{}
+	compare := func(key string, ballots map[string]int64, current map[string]string) {
+		fields := make([]string, 0, len(ballots)+len(current))
+		for f := range ballots {
+			fields = append(fields, f)
+		}
+		for f := range current {
+			if _, ok := ballots[f]; !ok {
+				fields = append(fields, f)
+			}
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			v, _ := strconv.ParseInt(current[f], 10, 64)
+			if v != ballots[f] {
+				drift = append(drift, Drift{
+					PollID:  hex,
+					Key:     key,
+					Field:   f,
+					Redis:   v,
+					Ballots: ballots[f],
+				})
+			}
+		}
+	}
+	for i, key := range keys {
+		compare(key, counts.hashes[key], cmds[i].Val())
+	}
+
+	return drift, nil
+}
+
+// RebuildTally replaces the tally of a poll in redis with one recomputed from its ballots in mongo and on the outbox.
+func RebuildTally(hex string) error {
+	poll, err := fetchPollFromMongo(hex)
+	if err != nil {
+		return err
+	}
+
+	counts, err := ballotTally(poll)
+	if err != nil {
+		return err
+	}
+
+	pipe := redis.Client.TxPipeline()
+	for key, values := range counts.hashes {
+		pipe.Del(redis.Ctx, key)
+		if len(values) > 0 {
+			fields := make(map[string]interface{}, len(values))
+			for f, v := range values {
+				fields[f] = v
+			}
+			pipe.HSet(redis.Ctx, key, fields)
+		}
+	}
+	if pollDedupMode(poll) != dedupNone {
+		key := fmt.Sprintf("poll:votes:%s:ips", hex)
+		pipe.Del(redis.Ctx, key)
+		if len(counts.voters) > 0 {
+			members := make([]interface{}, len(counts.voters))
+			for i, v := range counts.voters {
+				members[i] = v
+			}
+			pipe.SAdd(redis.Ctx, key, members...)
+		}
+	}
+	_, err = pipe.Exec(redis.Ctx)
+	return err
+}
+
+// AllPollIDs returns the id of every poll, for running tally commands over all polls.
+func AllPollIDs() ([]string, error) {
+	cur, err := mongo.Database.Collection("polls").Find(mongo.Ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(mongo.Ctx)
+
+	ids := []string{}
+	for cur.Next(mongo.Ctx) {
+		poll := mongo.Poll{}
+		if err = cur.Decode(&poll); err != nil {
+			return nil, err
+		}
+		ids = append(ids, poll.ID.Hex())
+	}
+	return ids, cur.Err()
+}
@@ -0,0 +1,62 @@
+package resolvers
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+)
+
+// Watches coalesce votes into at most one update per throttle, chosen by the client between watch_throttle_min and watch_throttle_max.
+// On top of that every watch on an instance shares watch_frame_budget updates per second, so the fan-out grows with the number
+// of watchers rather than the rate of votes.
+var activeWatches int64
+
+func watchThrottleMin() time.Duration {
+	if ms := configure.Config.GetInt("watch_throttle_min"); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 250 * time.Millisecond
+}
+
+func watchThrottleMax() time.Duration {
+	if ms := configure.Config.GetInt("watch_throttle_max"); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 30 * time.Second
+}
+
+func watchThrottleDefault() time.Duration {
+	if ms := configure.Config.GetInt("watch_throttle_default"); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Second
+}
+
+// watchThrottle returns the throttle of a watch, the requested one or the default clamped to the server limits.
+func watchThrottle(requested *int32) time.Duration {
+	throttle := watchThrottleDefault()
+	if requested != nil {
+		throttle = time.Duration(*requested) * time.Millisecond
+	}
+	if min := watchThrottleMin(); throttle < min {
+		throttle = min
+	}
+	if max := watchThrottleMax(); throttle > max {
+		throttle = max
+	}
+	return throttle
+}
+
+// watchInterval returns the time a watch waits between updates, its throttle stretched to keep every watch on the instance
+// within the frame budget. A budget of 0 disables the cap.
+func watchInterval(throttle time.Duration) time.Duration {
+	budget := configure.Config.GetInt("watch_frame_budget")
+	if budget <= 0 {
+		return throttle
+	}
+	if shared := time.Duration(atomic.LoadInt64(&activeWatches)) * time.Second / time.Duration(budget); shared > throttle {
+		return shared
+	}
+	return throttle
+}
@@ -0,0 +1,38 @@
+package resolvers
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/challenge"
+)
+
+// checkChallenge verifies the challenge token of a request that must pass human verification, returning the failing result state.
+// Nothing is checked when the server has no verifier configured.
+func checkChallenge(ctx context.Context, required bool, token *string) (string, error) {
+	if !required || challenge.Default == nil {
+		return "", nil
+	}
+	if token == nil || *token == "" {
+		return "CHALLENGE_REQUIRED", nil
+	}
+
+	vctx, cancel := context.WithTimeout(ctx, challenge.Timeout)
+	defer cancel()
+
+	ok, err := challenge.Default.Verify(vctx, *token, requestIP(ctx))
+	if err != nil {
+		log.Errorf("challenge, err=%v", err)
+		return "", errInternalServer
+	}
+	if !ok {
+		return "CHALLENGE_FAILED", nil
+	}
+	return "", nil
+}
+
+// challengeState reports if a result state failed human verification, these are not stored under idempotency keys
+// so a retry with a new challenge token is not answered with the old failure.
+func challengeState(state string) bool {
+	return state == "CHALLENGE_REQUIRED" || state == "CHALLENGE_FAILED"
+}
@@ -0,0 +1,276 @@
+package resolvers
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/configure"
+	"github.com/troydota/api.poll.komodohype.dev/mongo"
+	"github.com/troydota/api.poll.komodohype.dev/redis"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errTooManyPolls = fmt.Errorf("too many polls")
+
+func watchManyMax() int {
+	if n := configure.Config.GetInt("watch_many_max"); n > 0 {
+		return n
+	}
+	return 25
+}
+
+// WatchMany watches several polls in one stream, every frame is one of the polls so clients tell them apart by id.
+// Votes on any of the polls are sent together at most once per throttle, and a single goroutine serves the whole stream.
+func (r *RootResolver) WatchMany(ctx context.Context, args struct {
+	IDs        []string
+	ThrottleMs *int32
+}) (<-chan *pollResolver, error) {
+	field := generateSelectedFieldMap(ctx)
+
+	if len(args.IDs) > watchManyMax() {
+		return nil, errTooManyPolls
+	}
+
+	polls := []*mongo.Poll{}
+	seen := map[primitive.ObjectID]bool{}
+	for _, hex := range args.IDs {
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			return nil, errPollNotFound
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		// Every poll is counted as a watch of its own, so watching many at once costs as much as watching them one by one.
+		if wait := rateLimited("watch", map[string]string{"ip": requestIP(ctx), "poll": id.Hex()}); wait > 0 {
+			return nil, rateLimitedError{wait}.queryError()
+		}
+
+		poll, err := fetchPoll(id, field)
+		if err != nil {
+			return nil, err
+		}
+		if poll == nil {
+			return nil, errPollNotFound
+		}
+		polls = append(polls, poll)
+	}
+
+	rChan := make(chan *pollResolver, len(polls))
+
+	fetchVotes := wantsTally(field)
+	fetchWatchers := wantsWatchers(field)
+
+	// The first frame of every poll is queued before any update can be, rChan buffers one per poll.
+	scheduled := []*mongo.Poll{}
+	for _, poll := range polls {
+		rChan <- &pollResolver{clonePoll(poll), nil}
+		if pollStatus(poll) == pollStatusScheduled {
+			scheduled = append(scheduled, poll)
+		}
+	}
+
+	if !fetchVotes && !fetchWatchers && len(scheduled) == 0 {
+		close(rChan)
+		return rChan, nil
+	}
+
+	events := make(chan *redis.Message, 100)
+	voteChannels := map[string]*mongo.Poll{}
+	closedChannels := map[string]*mongo.Poll{}
+	releasedChannels := map[string]*mongo.Poll{}
+	watchersChannels := map[string]*mongo.Poll{}
+	for _, poll := range polls {
+		if fetchVotes {
+			voteChannels[fmt.Sprintf("events:poll:vote:%s", poll.ID.Hex())] = poll
+			closedChannels[fmt.Sprintf("events:poll:closed:%s", poll.ID.Hex())] = poll
+			releasedChannels[fmt.Sprintf("events:poll:released:%s", poll.ID.Hex())] = poll
+		}
+		if fetchWatchers {
+			watchersChannels[fmt.Sprintf("events:poll:watchers:%s", poll.ID.Hex())] = poll
+		}
+	}
+	subscribed := []string{}
+	for _, channels := range []map[string]*mongo.Poll{voteChannels, closedChannels, releasedChannels, watchersChannels} {
+		for c := range channels {
+			if err := r.subscribe(c, events); err != nil {
+				log.Errorf("redis, err=%v", err)
+				for _, c := range subscribed {
+					if err := r.unsubscribe(c, events); err != nil {
+						log.Errorf("redis, err=%v", err)
+					}
+				}
+				return nil, errInternalServer
+			}
+			subscribed = append(subscribed, c)
+		}
+	}
+
+	throttle := watchThrottle(args.ThrottleMs)
+	atomic.AddInt64(&activeWatches, int64(len(polls)))
+	for _, poll := range polls {
+		presence.add(poll.ID, 1)
+	}
+
+	go func() {
+		defer atomic.AddInt64(&activeWatches, -int64(len(polls)))
+		defer func() {
+			for _, poll := range polls {
+				presence.add(poll.ID, -1)
+			}
+		}()
+		defer func() {
+			for _, channels := range []map[string]*mongo.Poll{voteChannels, closedChannels, releasedChannels, watchersChannels} {
+				for c := range channels {
+					if err := r.unsubscribe(c, events); err != nil {
+						log.Errorf("redis, err=%v", err)
+					}
+				}
+			}
+		}()
+
+		// Scheduled polls are sent again when they open, one timer waits for whichever opens next.
+		var opened <-chan time.Time
+		var openTimer *time.Timer
+		nextOpening := func() {
+			opened = nil
+			var next *time.Time
+			for _, poll := range scheduled {
+				if next == nil || poll.OpensAt.Before(*next) {
+					next = poll.OpensAt
+				}
+			}
+			if next != nil {
+				openTimer = time.NewTimer(time.Until(*next))
+				opened = openTimer.C
+			}
+		}
+		nextOpening()
+
+		var flush <-chan time.Time
+		var flushTimer *time.Timer
+		defer func() {
+			if openTimer != nil {
+				openTimer.Stop()
+			}
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+		}()
+		var lastSent time.Time
+		pending := map[*mongo.Poll]bool{}
+		send := func(poll *mongo.Poll) {
+			select {
+			case rChan <- &pollResolver{clonePoll(poll), nil}:
+			case <-ctx.Done():
+			}
+			delete(pending, poll)
+		}
+		queue := func(poll *mongo.Poll) {
+			pending[poll] = true
+			if flush == nil {
+				wait := watchInterval(throttle) - time.Since(lastSent)
+				if wait < 0 {
+					wait = 0
+				}
+				flushTimer = time.NewTimer(wait)
+				flush = flushTimer.C
+			}
+		}
+
+		cursors := map[*mongo.Poll]*eventCursor{}
+		if fetchVotes {
+			for _, poll := range polls {
+				cursors[poll] = newEventCursor(poll.ID, *poll.Seq)
+			}
+		}
+		handle := func(poll *mongo.Poll, event storedEvent) {
+			for _, e := range cursors[poll].next(event) {
+				switch applyPollEvent(poll, e) {
+				case "vote", "released":
+					queue(poll)
+				case "closed":
+					// Closing is sent straight away, along with any votes on the poll still waiting on the throttle.
+					send(poll)
+				}
+			}
+		}
+
+		// Events published between reading the polls and subscribing only reached the streams.
+		if fetchVotes {
+			for _, poll := range polls {
+				missed, _, err := fetchEventsSince(poll.ID, *poll.Seq, -1)
+				if err != nil {
+					log.Errorf("redis, err=%v", err)
+				}
+				for _, e := range missed {
+					handle(poll, e)
+				}
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-opened:
+				waiting := scheduled[:0]
+				for _, poll := range scheduled {
+					if poll.OpensAt.After(now) {
+						waiting = append(waiting, poll)
+					} else {
+						send(poll)
+					}
+				}
+				scheduled = waiting
+				nextOpening()
+				if !fetchVotes && !fetchWatchers && len(scheduled) == 0 {
+					close(rChan)
+					return
+				}
+			case <-flush:
+				flush = nil
+				for _, poll := range polls {
+					if pending[poll] {
+						send(poll)
+					}
+				}
+				lastSent = time.Now()
+			case msg := <-events:
+				if poll, ok := voteChannels[msg.Channel]; ok {
+					event, err := parseEventMessage("vote", msg.Payload)
+					if err != nil {
+						log.Errorf("json, err=%v", err)
+						continue
+					}
+					handle(poll, event)
+				} else if poll, ok := closedChannels[msg.Channel]; ok {
+					event, err := parseEventMessage("closed", msg.Payload)
+					if err != nil {
+						log.Errorf("json, err=%v", err)
+						continue
+					}
+					handle(poll, event)
+				} else if poll, ok := releasedChannels[msg.Channel]; ok {
+					event, err := parseEventMessage("released", msg.Payload)
+					if err != nil {
+						log.Errorf("json, err=%v", err)
+						continue
+					}
+					handle(poll, event)
+				} else if poll, ok := watchersChannels[msg.Channel]; ok {
+					watchers := parseWatchers(msg.Payload)
+					poll.Watchers = &watchers
+					queue(poll)
+				}
+			}
+		}
+	}()
+
+	return rChan, nil
+}
@@ -0,0 +1,287 @@
+package gql
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/graph-gophers/graphql-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// The SSE endpoint streams subscriptions as text/event-stream for clients that cannot hold a websocket, such as OBS browser sources.
+// Every result is sent as a next event and the stream ends with a complete event.
+const sseKeepAlive = 15 * time.Second
+
+// sseResumable are the subscriptions that can pick up from the seq of the last event a client got, their frames carry the poll's
+// event seq as the event id and the Last-Event-ID of a reconnect is passed on as since_seq.
+var sseResumable = map[string]bool{
+	"watch":      true,
+	"pollEvents": true,
+}
+
+func isNameChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+type operation struct {
+	typ string
+	// body is where the selection set of the operation starts.
+	body int
+}
+
+// operationType returns the type of the operation a request runs, or an empty string when it cannot be found.
+// GET requests must not change anything, and the schema gives no way to tell a mutation apart before running it.
+func operationType(query string, operationName string) string {
+	return findOperation(query, operationName).typ
+}
+
+// findOperation returns the operation a request runs, or an empty operation when it cannot be found.
+func findOperation(query string, operationName string) operation {
+	ops := map[string]operation{}
+	// last is the name of the operation whose selection set comes next.
+	last := ""
+	depth := 0
+	// named is set between a definition keyword and the selection set it opens.
+	named := false
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], `"""`):
+			end := strings.Index(query[i+3:], `"""`)
+			if end == -1 {
+				return operation{}
+			}
+			i += end + 6
+		case ch == '"':
+			for i++; i < len(query) && query[i] != '"'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case ch == '{' || ch == '(' || ch == '[':
+			if depth == 0 && ch == '{' {
+				// A selection set without a keyword is a query.
+				if !named {
+					ops[""] = operation{"query", i + 1}
+				} else if op, ok := ops[last]; ok && op.body == 0 {
+					op.body = i + 1
+					ops[last] = op
+				}
+				named = false
+			}
+			depth++
+			i++
+		case ch == '}' || ch == ')' || ch == ']':
+			depth--
+			i++
+		case depth == 0 && isNameChar(ch):
+			start := i
+			for i < len(query) && isNameChar(query[i]) {
+				i++
+			}
+			word := query[start:i]
+			if named {
+				continue
+			}
+			switch word {
+			case "fragment":
+				named = true
+				last = "\x00fragment"
+			case "query", "mutation", "subscription":
+				named = true
+				for i < len(query) && strings.IndexByte(" \t\r\n,", query[i]) != -1 {
+					i++
+				}
+				nameStart := i
+				for i < len(query) && isNameChar(query[i]) {
+					i++
+				}
+				last = query[nameStart:i]
+				ops[last] = operation{word, 0}
+			}
+		default:
+			i++
+		}
+	}
+
+	if operationName == "" {
+		if len(ops) != 1 {
+			return operation{}
+		}
+		for _, op := range ops {
+			return op
+		}
+	}
+	return ops[operationName]
+}
+
+// rootField returns the name of the first field an operation selects, or an empty string when it starts with a fragment.
+func rootField(query string, op operation) string {
+	word := func(i int) (string, int) {
+		for i < len(query) {
+			if query[i] == '#' {
+				for i < len(query) && query[i] != '\n' {
+					i++
+				}
+			} else if strings.IndexByte(" \t\r\n,", query[i]) != -1 {
+				i++
+			} else {
+				break
+			}
+		}
+		start := i
+		for i < len(query) && isNameChar(query[i]) {
+			i++
+		}
+		return query[start:i], i
+	}
+
+	if op.body == 0 {
+		return ""
+	}
+	name, i := word(op.body)
+	// An alias is followed by a colon and the name of the field.
+	if _, j := word(i); j < len(query) && query[j] == ':' {
+		name, _ = word(j + 1)
+	}
+	return name
+}
+
+// frameSeq returns the seq in the result of a resumable subscription, false if it was not selected.
+func frameSeq(data []byte) (int32, bool) {
+	frame := map[string]*struct {
+		Seq *int32 `json:"seq"`
+	}{}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return 0, false
+	}
+	for _, v := range frame {
+		if v != nil && v.Seq != nil {
+			return *v.Seq, true
+		}
+	}
+	return 0, false
+}
+
+func sseHandler(schema *graphql.Schema, ips *ipResolver) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// The stream outlives the handler and fiber reuses the request buffer, so the request is copied out of it.
+		query := string(append([]byte(nil), c.Query("query")...))
+		operationName := string(append([]byte(nil), c.Query("operation_name")...))
+		if query == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  400,
+				"message": "Invalid GraphQL Request.",
+			})
+		}
+
+		op := findOperation(query, operationName)
+		if op.typ != "query" && op.typ != "subscription" {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  400,
+				"message": "Only queries and subscriptions can be sent over GET.",
+			})
+		}
+
+		variables := map[string]interface{}{}
+		if v := c.Query("variables"); v != "" {
+			if err := json.UnmarshalFromString(v, &variables); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"status":  400,
+					"message": "Invalid GraphQL Request.",
+				})
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(context.WithValue(context.Background(), utils.Key("ip"), ips.clientIP(c)), utils.Key("voter_token"), voterToken(c)))
+
+		// EventSource sends the id of the last event it saw when it reconnects. The frames of a resumable subscription use the poll's
+		// event seq as their id, so a reconnect picks up after the last event the client got, as if it had passed since_seq.
+		// Other subscriptions send no ids and start over from the full state of their polls.
+		resumable := sseResumable[rootField(query, op)]
+		if resumable {
+			lastID := c.Get("Last-Event-ID")
+			if lastID == "" {
+				lastID = c.Query("last_event_id")
+			}
+			if seq, err := strconv.ParseInt(lastID, 10, 32); err == nil && seq >= 0 {
+				ctx = context.WithValue(ctx, utils.Key("since_seq"), int32(seq))
+			}
+		}
+
+		results, err := schema.Subscribe(ctx, query, operationName, variables)
+		if err != nil {
+			cancel()
+			log.Errorf("gql, err=%v", err)
+			return c.Status(500).JSON(fiber.Map{
+				"status":  500,
+				"message": "Failed to subscribe.",
+			})
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		// Stops nginx from buffering the stream.
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer cancel()
+
+			tick := time.NewTicker(sseKeepAlive)
+			defer tick.Stop()
+
+			// Writes fail once the client is gone, which is the only way a stream learns it was closed.
+			flush := func() bool {
+				return w.Flush() == nil
+			}
+
+			if _, err := w.WriteString(": connected\n\n"); err != nil || !flush() {
+				return
+			}
+
+			for {
+				select {
+				case val, ok := <-results:
+					if !ok {
+						_, _ = w.WriteString("event: complete\ndata:\n\n")
+						flush()
+						return
+					}
+					data, err := json.Marshal(val)
+					if err != nil {
+						log.Errorf("json, err=%v", err)
+						continue
+					}
+					// Frames without a seq keep the id of the frame before them.
+					id := ""
+					if res, ok := val.(*graphql.Response); ok && resumable {
+						if seq, ok := frameSeq(res.Data); ok {
+							id = fmt.Sprintf("id: %d\n", seq)
+						}
+					}
+					if _, err = fmt.Fprintf(w, "%sevent: next\ndata: %s\n\n", id, data); err != nil || !flush() {
+						return
+					}
+				case <-tick.C:
+					if _, err := w.WriteString(": ping\n\n"); err != nil || !flush() {
+						return
+					}
+				}
+			}
+		})
+
+		return nil
+	}
+}
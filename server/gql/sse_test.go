@@ -0,0 +1,148 @@
+package gql
+
+import "testing"
+
+func TestFindOperation(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		typ           string
+		root          string
+	}{
+		{
+			name:  "shorthand query",
+			query: `{ poll(id: "x") { id } }`,
+			typ:   "query",
+			root:  "poll",
+		},
+		{
+			name:  "named subscription",
+			query: `subscription Watch { watch(id: "x") { seq } }`,
+			typ:   "subscription",
+			root:  "watch",
+		},
+		{
+			name:  "mutation",
+			query: `mutation { vote(id: "x", selection: [0]) }`,
+			typ:   "mutation",
+			root:  "vote",
+		},
+		{
+			name: "block string",
+			query: `query Q { poll(id: """
+				} mutation { vote
+			""") { id } }`,
+			typ:  "query",
+			root: "poll",
+		},
+		{
+			name:  "unterminated block string",
+			query: `query Q { poll(id: """ { id } }`,
+		},
+		{
+			name:  "escaped quotes",
+			query: `subscription { watch(id: "a\"} mutation {\\") { seq } }`,
+			typ:   "subscription",
+			root:  "watch",
+		},
+		{
+			name:  "comments",
+			query: "# mutation { vote }\nsubscription { # } mutation {\n watch(id: \"x\") { seq } }",
+			typ:   "subscription",
+			root:  "watch",
+		},
+		{
+			name:  "variable defaults",
+			query: `query Q($in: Input = {a: [1, {b: 2}]}) { poll(id: "x") { id } }`,
+			typ:   "query",
+			root:  "poll",
+		},
+		{
+			name:  "fragment before the operation",
+			query: "fragment F on Poll { id title }\nsubscription S { watch(id: \"x\") { ...F } }",
+			typ:   "subscription",
+			root:  "watch",
+		},
+		{
+			name:  "fragment spread as the root",
+			query: "fragment F on Subscription { watch(id: \"x\") { seq } }\nsubscription S { ...F }",
+			typ:   "subscription",
+			root:  "",
+		},
+		{
+			name:  "anonymous and named operations without a name",
+			query: `query { poll(id: "x") { id } } subscription S { watch(id: "x") { seq } }`,
+		},
+		{
+			name:          "anonymous and named operations by name",
+			query:         `query { poll(id: "x") { id } } subscription S { watch(id: "x") { seq } }`,
+			operationName: "S",
+			typ:           "subscription",
+			root:          "watch",
+		},
+		{
+			name:          "named operations by name",
+			query:         `query A { poll(id: "x") { id } } mutation B { vote(id: "x", selection: [0]) }`,
+			operationName: "B",
+			typ:           "mutation",
+			root:          "vote",
+		},
+		{
+			name:  "named operations without a name",
+			query: `query A { poll(id: "x") { id } } mutation B { vote(id: "x", selection: [0]) }`,
+		},
+		{
+			name:          "unknown operation name",
+			query:         `query A { poll(id: "x") { id } }`,
+			operationName: "B",
+		},
+		{
+			name:  "aliased root field",
+			query: `subscription { w: watch(id: "x") { seq } }`,
+			typ:   "subscription",
+			root:  "watch",
+		},
+		{
+			name:  "aliased root field with a comment",
+			query: "subscription {\n  w # the poll\n  : pollEvents(id: \"x\") { seq }\n}",
+			typ:   "subscription",
+			root:  "pollEvents",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := findOperation(tt.query, tt.operationName)
+			if op.typ != tt.typ {
+				t.Errorf("type = %q, want %q", op.typ, tt.typ)
+			}
+			if root := rootField(tt.query, op); root != tt.root {
+				t.Errorf("root = %q, want %q", root, tt.root)
+			}
+		})
+	}
+}
+
+func TestFrameSeq(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		seq  int32
+		ok   bool
+	}{
+		{"seq selected", `{"watch":{"id":"x","seq":5}}`, 5, true},
+		{"seq not selected", `{"watch":{"id":"x"}}`, 0, false},
+		{"null result", `{"watch":null}`, 0, false},
+		{"invalid json", `{"watch":`, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seq, ok := frameSeq([]byte(tt.data))
+			if seq != tt.seq || ok != tt.ok {
+				t.Errorf("frameSeq = %d %v, want %d %v", seq, ok, tt.seq, tt.ok)
+			}
+		})
+	}
+}
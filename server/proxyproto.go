@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections that may start with a PROXY protocol v1 or v2 header, as sent by load balancers
+// such as haproxy or aws nlb, and reports the client address from the header as the remote address of the connection.
+// Headers are only read from trusted proxies, connections from any other peer keep their real address.
+type proxyListener struct {
+	net.Listener
+	trusted utils.Networks
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := false
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		trusted = l.trusted.Contains(addr.IP)
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		trusted: trusted,
+	}, nil
+}
+
+// proxyConn reads the PROXY protocol header on first use, so a slow client does not hold up accepting other connections.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if !c.trusted {
+			return
+		}
+
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+		addr, err := readProxyHeader(c.r)
+		if err != nil {
+			log.Warnf("proxy protocol, remote=%s err=%v", c.remote, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+		c.err = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header if the connection starts with one, returning the client address it carries.
+// The address is nil when there is no header or the header does not carry one, such as health checks from the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, nil
+}
+
+// readProxyV1 parses a header of the form "PROXY TCP4 <src> <dst> <src port> <dst port>\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes.
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("proxy v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(utils.B2S(line))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid proxy v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid proxy v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 parses a binary header, only the tcp over ipv4 and ipv6 address families carry a client address.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy v2 version")
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is sent by the proxy for its own connections, they keep their real address.
+	if header[12]&0xF == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("invalid proxy v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("invalid proxy v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/troydota/api.poll.komodohype.dev/utils"
+)
+
+// proxyV2 builds a v2 header with the given version and command byte, address family byte and body.
+func proxyV2(verCmd byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return append(header, body...)
+}
+
+// proxyV2Body builds the address block of a v2 header, source then destination address followed by their ports.
+func proxyV2Body(src net.IP, dst net.IP, srcPort uint16, dstPort uint16) []byte {
+	body := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(body, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	request := "GET / HTTP/1.1\r\n\r\n"
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{
+			name:   "no header",
+			header: []byte{},
+		},
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			addr:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:   "v1 unsupported protocol",
+			header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			err:    true,
+		},
+		{
+			name:   "v1 invalid address",
+			header: []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"),
+			err:    true,
+		},
+		{
+			name:   "v1 port out of range",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"),
+			err:    true,
+		},
+		{
+			name:   "v1 too long",
+			header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+			err:    true,
+		},
+		{
+			name: "v2 proxy tcp4",
+			header: proxyV2(0x21, 0x11, proxyV2Body(
+				net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 443,
+			)),
+			addr: "192.0.2.1:56324",
+		},
+		{
+			name: "v2 proxy tcp6",
+			header: proxyV2(0x21, 0x21, proxyV2Body(
+				net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443,
+			)),
+			addr: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2 local",
+			header: proxyV2(0x20, 0x00, nil),
+		},
+		{
+			name: "v2 local ignores its addresses",
+			header: proxyV2(0x20, 0x11, proxyV2Body(
+				net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 443,
+			)),
+		},
+		{
+			name:   "v2 proxy udp4",
+			header: proxyV2(0x21, 0x12, make([]byte, 12)),
+		},
+		{
+			name:   "v2 proxy tcp4 short address",
+			header: proxyV2(0x21, 0x11, make([]byte, 8)),
+			err:    true,
+		},
+		{
+			name:   "v2 unsupported version",
+			header: proxyV2(0x11, 0x11, make([]byte, 12)),
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, tt.header...), request...)))
+			addr, err := readProxyHeader(r)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("err = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.addr {
+				t.Errorf("addr = %q, want %q", got, tt.addr)
+			}
+
+			// The header is consumed and the request after it is left untouched.
+			rest, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if string(rest) != request {
+				t.Errorf("rest = %q, want %q", rest, request)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTruncated(t *testing.T) {
+	full := proxyV2(0x21, 0x11, proxyV2Body(
+		net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 443,
+	))
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"v1 without line end", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443")},
+		{"v2 without length", full[:14]},
+		{"v2 body cut short", full[:len(full)-3]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.header))); err == nil {
+				t.Errorf("err = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestProxyListenerTrust(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+	request := "GET / HTTP/1.1\r\n\r\n"
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		data    string
+	}{
+		// A peer that is not a trusted proxy keeps its real address, and its header is passed on as request data.
+		{"untrusted peer", "10.0.0.0/8", "127.0.0.1", header + request},
+		{"trusted peer", "127.0.0.1", "192.0.2.1", request},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := utils.ParseNetworks([]string{tt.trusted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skipf("cannot listen on loopback: %v", err)
+			}
+			l := &proxyListener{ln, trusted}
+			defer l.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_, _ = c.Write([]byte(header + request))
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.remote {
+				t.Errorf("remote = %s, want %s", host, tt.remote)
+			}
+			data, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.data {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+		})
+	}
+}
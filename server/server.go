@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/davecgh/go-spew/spew"
@@ -37,6 +38,16 @@ func NewServer() *Server {
 	ln, err := net.Listen(configure.Config.GetString("listener_network"), configure.Config.GetString("listener_address"))
 	checkErr(err)
 
+	if configure.Config.GetBool("proxy_protocol") {
+		trusted, err := utils.ParseNetworks(configure.Config.GetStringSlice("trusted_proxies"))
+		checkErr(err)
+		// Anyone could claim any address in a PROXY header, so only the proxies in front of the server are allowed to send one.
+		if len(trusted) == 0 {
+			checkErr(fmt.Errorf("proxy_protocol needs trusted_proxies"))
+		}
+		ln = &proxyListener{ln, trusted}
+	}
+
 	server := &Server{
 		ln: ln,
 		app: fiber.New(fiber.Config{
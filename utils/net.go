@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"net"
+	"strings"
+)
+
+// Networks is a list of ip networks, such as the trusted proxies.
+type Networks []*net.IPNet
+
+// ParseNetworks parses a list of CIDRs, bare ips are taken as a network of that single ip.
+func ParseNetworks(list []string) (Networks, error) {
+	nets := Networks{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Contains reports if an ip is in any of the networks.
+func (n Networks) Contains(ip net.IP) bool {
+	for _, v := range n {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}